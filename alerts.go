@@ -0,0 +1,469 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// === ALERT RULES ===
+
+// alertKinds are the kinds of alert: the accepted AlertRule types and
+// QuietHours.Alerts values.
+var alertKinds = []string{"depeg", "percent", "ma", "price"}
+
+// AlertRule is one entry of AlertRules. Type picks the kind of alert and
+// which parameters apply:
+//
+//	percent: Percent, the move between two fetches that fires it
+//	price:   Above and/or Below, absolute bounds to cross
+//	ma:      ShortMinutes and LongMinutes, the averages that cross
+//	depeg:   Threshold, the dollars from $1.00 allowed (default 0.01)
+//
+// Prices are in the first configured currency; depeg always uses usd.
+type AlertRule struct {
+	Type         string  `json:"type"`
+	Coin         string  `json:"coin"`
+	Percent      float64 `json:"percent,omitempty"`
+	Above        float64 `json:"above,omitempty"`
+	Below        float64 `json:"below,omitempty"`
+	ShortMinutes int     `json:"short_minutes,omitempty"`
+	LongMinutes  int     `json:"long_minutes,omitempty"`
+	Threshold    float64 `json:"threshold,omitempty"`
+}
+
+// params lists the parameters set on r, by JSON name.
+func (r AlertRule) params() []string {
+	var out []string
+	for _, p := range []struct {
+		name string
+		set  bool
+	}{
+		{"percent", r.Percent != 0}, {"above", r.Above != 0}, {"below", r.Below != 0},
+		{"short_minutes", r.ShortMinutes != 0}, {"long_minutes", r.LongMinutes != 0},
+		{"threshold", r.Threshold != 0},
+	} {
+		if p.set {
+			out = append(out, p.name)
+		}
+	}
+	return out
+}
+
+// alertRuleParams are the parameters each rule type takes.
+var alertRuleParams = map[string][]string{
+	"percent": {"percent"},
+	"price":   {"above", "below"},
+	"ma":      {"short_minutes", "long_minutes"},
+	"depeg":   {"threshold"},
+}
+
+// validateAlertRules checks each rule's type, coin and parameters, naming
+// the rule by its index.
+func validateAlertRules(rules []AlertRule, coins []CoinSpec, currencies []string) error {
+	var errs []error
+	for i, r := range rules {
+		bad := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("alert_rules[%d]: "+format, append([]any{i}, args...)...))
+		}
+		if !slices.Contains(alertKinds, r.Type) {
+			bad("type must be one of %s, got %q", strings.Join(alertKinds, ", "), r.Type)
+			continue
+		}
+		if !hasCoin(coins, r.Coin) {
+			bad("coin %q is not in coins", r.Coin)
+		}
+		for _, p := range r.params() {
+			if !slices.Contains(alertRuleParams[r.Type], p) {
+				bad("%s doesn't apply to %s rules", p, r.Type)
+			}
+		}
+		switch r.Type {
+		case "percent":
+			if r.Percent <= 0 {
+				bad("percent rules need percent > 0, got %g", r.Percent)
+			}
+		case "price":
+			if r.Above < 0 || r.Below < 0 || r.Above == 0 && r.Below == 0 {
+				bad("price rules need above and/or below > 0")
+			}
+		case "ma":
+			if r.ShortMinutes <= 0 || r.LongMinutes <= r.ShortMinutes {
+				bad("ma rules need 0 < short_minutes < long_minutes, got %d/%d", r.ShortMinutes, r.LongMinutes)
+			}
+		case "depeg":
+			if r.Threshold < 0 || r.Threshold >= 1 {
+				bad("depeg rules need threshold between 0 and 1 dollar (0 uses the default of %g), got %g", defaultDepegThreshold, r.Threshold)
+			}
+			if !slices.Contains(currencies, "usd") {
+				bad("depeg rules need usd in currencies")
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// alertSet is every alert rule in effect, from both the per-kind config
+// fields and AlertRules.
+type alertSet struct {
+	percent map[string]float64 // coin id → threshold percent
+	price   []PriceAlert
+	ma      []MARule
+	pegs    []peg
+}
+
+// activeAlerts merges cfg's alert settings into one alertSet. A percent or
+// depeg rule for a coin replaces the threshold the per-kind fields give it.
+func activeAlerts(cfg Config) alertSet {
+	set := alertSet{percent: map[string]float64{}}
+	if cfg.AlertThresholdPercent > 0 {
+		for _, c := range cfg.Coins {
+			set.percent[c.ID] = cfg.AlertThresholdPercent
+		}
+	}
+	for i, r := range cfg.PriceAlerts {
+		r.name = fmt.Sprintf("price_alerts[%d]", i)
+		set.price = append(set.price, r)
+	}
+	set.ma = slices.Clone(cfg.MAAlerts)
+	for _, id := range cfg.Stablecoins {
+		set.pegs = append(set.pegs, peg{ID: id, Threshold: cfg.DepegThreshold})
+	}
+	for i, r := range cfg.AlertRules {
+		switch r.Type {
+		case "percent":
+			set.percent[r.Coin] = r.Percent
+		case "price":
+			set.price = append(set.price, PriceAlert{Coin: r.Coin, Above: r.Above, Below: r.Below, name: fmt.Sprintf("alert_rules[%d]", i)})
+		case "ma":
+			set.ma = append(set.ma, MARule{Coin: r.Coin, ShortMinutes: r.ShortMinutes, LongMinutes: r.LongMinutes})
+		case "depeg":
+			if j := slices.IndexFunc(set.pegs, func(p peg) bool { return p.ID == r.Coin }); j >= 0 {
+				set.pegs[j].Threshold = r.Threshold
+			} else {
+				set.pegs = append(set.pegs, peg{ID: r.Coin, Threshold: r.Threshold})
+			}
+		}
+	}
+	return set
+}
+
+// === MOVING AVERAGE ALERTS ===
+
+// MARule fires when a coin's short moving average crosses its long one.
+type MARule struct {
+	Coin         string `json:"coin"`
+	ShortMinutes int    `json:"short_minutes"`
+	LongMinutes  int    `json:"long_minutes"`
+}
+
+func (r MARule) short() time.Duration { return time.Duration(r.ShortMinutes) * time.Minute }
+func (r MARule) long() time.Duration  { return time.Duration(r.LongMinutes) * time.Minute }
+
+func (r MARule) String() string {
+	return fmt.Sprintf("%s %s/%s", r.Coin, formatWindow(r.short()), formatWindow(r.long()))
+}
+
+// validateMARules checks each rule against the configured coins.
+func validateMARules(rules []MARule, coins []CoinSpec) error {
+	var errs []error
+	for i, r := range rules {
+		if !hasCoin(coins, r.Coin) {
+			errs = append(errs, fmt.Errorf("ma_alerts[%d]: coin %q is not in coins", i, r.Coin))
+		}
+		if r.ShortMinutes <= 0 || r.LongMinutes <= r.ShortMinutes {
+			errs = append(errs, fmt.Errorf("ma_alerts[%d]: need 0 < short_minutes < long_minutes, got %d/%d", i, r.ShortMinutes, r.LongMinutes))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// maTracker remembers, per rule, whether the short average was last above
+// the long one, so alerts fire only when that flips.
+type maTracker struct {
+	above map[string]bool
+}
+
+func newMATracker() *maTracker {
+	return &maTracker{above: map[string]bool{}}
+}
+
+// evaluate checks every rule and returns one line per crossover. A rule's
+// first evaluation only records its state; rules for coins not in coins, or
+// without enough history, are skipped.
+func (t *maTracker) evaluate(st Store, rules []MARule, coins []CoinSpec, currency string) []string {
+	var lines []string
+	for _, r := range rules {
+		if !hasCoin(coins, r.Coin) {
+			continue
+		}
+		short, err := st.MovingAverage(r.Coin, currency, r.short())
+		if err == nil {
+			var long float64
+			long, err = st.MovingAverage(r.Coin, currency, r.long())
+			if err == nil {
+				if line, ok := t.update(r, short, long, coins, currency); ok {
+					lines = append(lines, line)
+				}
+				continue
+			}
+		}
+		if errors.Is(err, errNotEnoughHistory) {
+			slog.Info("moving average skipped", "event", "ma_not_enough_history", "rule", r.String())
+		} else {
+			slog.Warn("moving average query failed", "event", "ma_error", "rule", r.String(), "error", err)
+		}
+	}
+	return lines
+}
+
+func (t *maTracker) update(r MARule, short, long float64, coins []CoinSpec, currency string) (string, bool) {
+	key := r.String()
+	above := short > long
+	prev, seen := t.above[key]
+	t.above[key] = above
+	if !seen || prev == above || short == long {
+		return "", false
+	}
+	dir := "below"
+	if above {
+		dir = "above"
+	}
+	coin := coinByID(coins, r.Coin)
+	d := coin.decimals(short)
+	return fmt.Sprintf("%s: %s MA %s crossed %s %s MA %s",
+		coinSymbol(coin),
+		formatWindow(r.short()), formatFixed(currency, short, d), dir,
+		formatWindow(r.long()), formatFixed(currency, long, d)), true
+}
+
+func formatMAAlert(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return "📈 *Moving average crossover*\n\n" + strings.Join(lines, "\n")
+}
+
+// formatWindow renders a duration like "1h30m" or "24h", dropping the zero
+// units time.Duration.String adds.
+func formatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// === PRICE THRESHOLD ALERTS ===
+
+// PriceAlert fires when Coin's price crosses above Above or below Below.
+// Either bound may be zero to leave it unused.
+type PriceAlert struct {
+	Coin  string  `json:"coin"`
+	Above float64 `json:"above"`
+	Below float64 `json:"below"`
+	// name is the rule's place in the config, e.g. "price_alerts[0]", as
+	// quoted in its alert lines.
+	name string
+}
+
+func validatePriceAlerts(rules []PriceAlert, coins []CoinSpec) error {
+	var errs []error
+	for i, r := range rules {
+		if !hasCoin(coins, r.Coin) {
+			errs = append(errs, fmt.Errorf("price_alerts[%d]: coin %q is not in coins", i, r.Coin))
+		}
+		if r.Above <= 0 && r.Below <= 0 {
+			errs = append(errs, fmt.Errorf("price_alerts[%d]: set above and/or below", i))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// priceAlertTracker remembers which side of each bound a price was on at
+// the last evaluation, so a rule fires once per crossing rather than on
+// every run while the price stays past it.
+type priceAlertTracker struct {
+	past map[string]bool
+}
+
+func newPriceAlertTracker() *priceAlertTracker {
+	return &priceAlertTracker{past: map[string]bool{}}
+}
+
+// evaluate returns one line per bound crossed since the previous run. The
+// first time a bound is seen its state is seeded from lastPrices when
+// available, so a price that was already past it doesn't fire.
+func (t *priceAlertTracker) evaluate(rules []PriceAlert, coins []CoinSpec, currency string, prices, lastPrices map[string]map[string]float64) []string {
+	var lines []string
+	for i, r := range rules {
+		price, ok := prices[r.Coin][currency]
+		if !ok {
+			continue
+		}
+		last, hasLast := lastPrices[r.Coin][currency]
+		coin := coinByID(coins, r.Coin)
+		symbol := coinSymbol(coin)
+		d := coin.decimals(price)
+		name := r.name
+		if name == "" {
+			name = fmt.Sprintf("price_alerts[%d]", i)
+		}
+		check := func(kind string, bound float64, past func(float64) bool) {
+			if bound <= 0 {
+				return
+			}
+			key := fmt.Sprintf("%s/%s/%g", r.Coin, kind, bound)
+			prev, seen := t.past[key]
+			if !seen && hasLast {
+				prev, seen = past(last), true
+			}
+			now := past(price)
+			t.past[key] = now
+			if seen && now && !prev {
+				lines = append(lines, fmt.Sprintf("%s crossed %s %s: now %s (%s)",
+					symbol, kind, formatFixed(currency, bound, d), formatFixed(currency, price, d), name))
+			}
+		}
+		check("above", r.Above, func(v float64) bool { return v > r.Above })
+		check("below", r.Below, func(v float64) bool { return v < r.Below })
+	}
+	return lines
+}
+
+func formatPriceAlert(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return "🎯 *Price alert*\n\n" + strings.Join(lines, "\n")
+}
+
+// === PERCENT ALERT COOLDOWN ===
+
+// dramaticMoveFactor is how many times larger than a coin's last alerted
+// move a new one must be to break through its cooldown.
+const dramaticMoveFactor = 2
+
+// alertCooldown remembers when each coin last fired a percent alert, so a
+// volatile stretch produces one alert per cooldown rather than one per run.
+type alertCooldown struct {
+	last map[string]lastAlert
+}
+
+type lastAlert struct {
+	at         time.Time
+	pct        float64
+	suppressed int
+}
+
+func newAlertCooldown() *alertCooldown {
+	return &alertCooldown{last: map[string]lastAlert{}}
+}
+
+// filter drops moves for coins that alerted less than cooldown ago, unless
+// the move is dramaticMoveFactor times the last one, and returns the rest
+// with the number suppressed since each coin last fired. A zero cooldown
+// lets everything through.
+func (c *alertCooldown) filter(moves []percentMove, cooldown time.Duration, now time.Time) []percentMove {
+	if cooldown <= 0 {
+		return moves
+	}
+	var out []percentMove
+	for _, m := range moves {
+		prev, seen := c.last[m.Coin.ID]
+		if seen && now.Sub(prev.at) < cooldown && math.Abs(m.Pct) < dramaticMoveFactor*math.Abs(prev.pct) {
+			prev.suppressed++
+			c.last[m.Coin.ID] = prev
+			slog.Info("percent alert suppressed by cooldown", "event", "alert_suppressed", "coin", m.Coin.ID, "change_pct", m.Pct, "suppressed", prev.suppressed)
+			continue
+		}
+		m.Suppressed = prev.suppressed
+		c.last[m.Coin.ID] = lastAlert{at: now, pct: m.Pct}
+		out = append(out, m)
+	}
+	return out
+}
+
+// === DEPEG ALERTS ===
+
+// defaultDepegThreshold is the allowed distance from $1.00 when
+// DepegThreshold is unset.
+const defaultDepegThreshold = 0.01
+
+func validateStablecoins(ids []string, coins []CoinSpec, currencies []string, threshold float64) error {
+	var errs []error
+	for i, id := range ids {
+		if !hasCoin(coins, id) {
+			errs = append(errs, fmt.Errorf("stablecoins[%d]: coin %q is not in coins", i, id))
+		}
+	}
+	if len(ids) > 0 && !slices.Contains(currencies, "usd") {
+		errs = append(errs, errors.New("stablecoins need usd in currencies"))
+	}
+	if threshold < 0 || threshold >= 1 {
+		errs = append(errs, fmt.Errorf("depeg_threshold must be between 0 and 1 dollar (0 uses the default of %g), got %g", defaultDepegThreshold, threshold))
+	}
+	return errors.Join(errs...)
+}
+
+// depegTracker remembers which stablecoins were outside the band at the last
+// evaluation, so a depeg alerts once when it starts and once when it ends
+// rather than on every run.
+type depegTracker struct {
+	out map[string]bool
+}
+
+func newDepegTracker() *depegTracker {
+	return &depegTracker{out: map[string]bool{}}
+}
+
+// peg is a stablecoin to watch and how many dollars it may drift from
+// $1.00; zero uses defaultDepegThreshold.
+type peg struct {
+	ID        string
+	Threshold float64
+}
+
+// evaluate checks each stablecoin's USD price against $1.00 ± its threshold
+// and returns a line for every coin that left or returned to the band.
+// Prices get four decimals since formatAmount's two would hide small depegs.
+func (t *depegTracker) evaluate(pegs []peg, coins []CoinSpec, prices map[string]map[string]float64) []string {
+	var lines []string
+	for _, p := range pegs {
+		id, threshold := p.ID, p.Threshold
+		if threshold <= 0 {
+			threshold = defaultDepegThreshold
+		}
+		price, ok := prices[id]["usd"]
+		if !ok {
+			continue
+		}
+		out := math.Abs(price-1) > threshold
+		was := t.out[id]
+		t.out[id] = out
+		symbol := coinSymbol(coinByID(coins, id))
+		switch {
+		case out && !was:
+			slog.Warn("stablecoin depegged", "event", "depeg", "coin", id, "price", price)
+			lines = append(lines, fmt.Sprintf("%s at %s, %s off the %s peg", symbol, formatFixed("usd", price, 4), formatPercent((price-1)*100, 2), formatFixed("usd", 1, 2)))
+		case was && !out:
+			slog.Info("stablecoin back on peg", "event", "depeg_recovered", "coin", id, "price", price)
+			lines = append(lines, fmt.Sprintf("%s back within %s of %s at %s", symbol, formatAmount("usd", threshold), formatFixed("usd", 1, 2), formatFixed("usd", price, 4)))
+		}
+	}
+	return lines
+}
+
+func formatDepegAlert(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return "⚠️ *DEPEG*\n\n" + strings.Join(lines, "\n")
+}
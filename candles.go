@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// === CANDLES ===
+
+// Candle is the open/high/low/close of one coin over [Time, Time+interval).
+// Count is the number of stored prices in it, 0 for a carried-forward
+// bucket.
+type Candle struct {
+	Time  time.Time `json:"time"`
+	Open  float64   `json:"open"`
+	High  float64   `json:"high"`
+	Low   float64   `json:"low"`
+	Close float64   `json:"close"`
+	Count int       `json:"count"`
+}
+
+// maxCandles bounds one buildCandles result.
+const maxCandles = 5000
+
+var errTooManyCandles = errors.New("too many candles for that range and interval")
+
+// buildCandles buckets the stored prices of coin in currency between from
+// and to into candles of interval, aligned to multiples of interval (UTC).
+// Buckets with no prices are skipped, or with carry filled from the
+// previous close so the series has no gaps.
+func buildCandles(db *DB, coin, currency string, interval time.Duration, from, to time.Time, carry bool) ([]Candle, error) {
+	rows, err := db.Query(`SELECT price_usd, created_at FROM prices
+		WHERE coin = ? AND currency = ? AND created_at >= ? AND created_at <= ?
+		ORDER BY created_at ASC`,
+		coin, currency, from.UTC().Format(sqliteTime), to.UTC().Format(sqliteTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Candle
+	for rows.Next() {
+		var (
+			price float64
+			at    time.Time
+		)
+		if err := rows.Scan(&price, &at); err != nil {
+			return nil, err
+		}
+		bucket := at.UTC().Truncate(interval)
+		if n := len(out); n > 0 && out[n-1].Time.Equal(bucket) {
+			c := &out[n-1]
+			c.High = max(c.High, price)
+			c.Low = min(c.Low, price)
+			c.Close = price
+			c.Count++
+			continue
+		}
+		if n := len(out); carry && n > 0 {
+			prev := out[n-1]
+			for t := prev.Time.Add(interval); t.Before(bucket); t = t.Add(interval) {
+				out = append(out, Candle{Time: t, Open: prev.Close, High: prev.Close, Low: prev.Close, Close: prev.Close})
+				if len(out) > maxCandles {
+					return nil, errTooManyCandles
+				}
+			}
+		}
+		out = append(out, Candle{Time: bucket, Open: price, High: price, Low: price, Close: price, Count: 1})
+		if len(out) > maxCandles {
+			return nil, errTooManyCandles
+		}
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// === COIN METADATA ===
+
+// coinMeta is a coin's entry in CoinGecko's /coins/list.
+type coinMeta struct {
+	ID     string `json:"id"`
+	Symbol string `json:"symbol"`
+	Name   string `json:"name"`
+}
+
+// fetchCoinList downloads every coin CoinGecko knows, a few MB uncompressed.
+func fetchCoinList(ctx context.Context, cfg Config) ([]coinMeta, error) {
+	resp, err := coinGeckoGet(ctx, cfg, "/coins/list")
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode != 200 {
+		return nil, &statusError{Service: "coingecko", Code: resp.StatusCode}
+	}
+	var list []coinMeta
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// coinMetaRetry is how long a coin missing from CoinGecko's list is
+// remembered as unknown before the list is downloaded again for it.
+const coinMetaRetry = 24 * time.Hour
+
+const (
+	upsertCoinMetaSQL = "INSERT INTO coins_meta (id, symbol, name, fetched_at) VALUES "
+	coinMetaParams    = 4
+	coinMetaConflict  = " ON CONFLICT (id) DO UPDATE SET symbol = excluded.symbol, name = excluded.name, fetched_at = excluded.fetched_at"
+)
+
+// saveCoinMeta stores list in coins_meta in one transaction, replacing the
+// entries already there. An entry with no symbol records a coin CoinGecko
+// didn't know.
+func saveCoinMeta(ctx context.Context, db *DB, list []coinMeta) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	at := now().UTC().Format(sqliteTime)
+	for batch := range slices.Chunk(list, maxSQLParams/coinMetaParams) {
+		var sb strings.Builder
+		sb.WriteString(upsertCoinMetaSQL)
+		args := make([]any, 0, len(batch)*coinMetaParams)
+		for i, m := range batch {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString("(?, ?, ?, ?)")
+			args = append(args, m.ID, m.Symbol, m.Name, at)
+		}
+		sb.WriteString(coinMetaConflict)
+		if _, err := tx.ExecContext(ctx, sb.String(), args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// loadCoinMeta returns the stored metadata for ids, keyed by id. Unknown
+// coins recorded before unknownSince are left out so they are looked up
+// again.
+func loadCoinMeta(ctx context.Context, db *DB, ids []string, unknownSince time.Time) (map[string]coinMeta, error) {
+	out := map[string]coinMeta{}
+	since := unknownSince.UTC().Format(sqliteTime)
+	for batch := range slices.Chunk(ids, maxSQLParams-1) {
+		args := make([]any, 0, len(batch)+1)
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		args = append(args, since)
+		q := "SELECT id, symbol, name FROM coins_meta WHERE id IN (?" + strings.Repeat(", ?", len(batch)-1) + ") AND (symbol <> '' OR fetched_at >= ?)"
+		rows, err := db.QueryContext(ctx, q, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var m coinMeta
+			if err := rows.Scan(&m.ID, &m.Symbol, &m.Name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out[m.ID] = m
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// resolveCoinMeta returns the metadata of cfg's coins that have no
+// configured symbol. Coins missing from coins_meta are looked up once in
+// CoinGecko's coin list, which is then stored whole so later coins resolve
+// without another download. Coins the list doesn't have are stored too, so
+// they aren't looked up again for coinMetaRetry. Failures are logged and
+// leave the coins out; they keep their uppercased id as symbol.
+func resolveCoinMeta(ctx context.Context, cfg Config, db *DB) map[string]coinMeta {
+	var ids []string
+	for _, c := range cfg.Coins {
+		if c.autoSymbol {
+			ids = append(ids, c.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	meta, err := loadCoinMeta(ctx, db, ids, now().Add(-coinMetaRetry))
+	if err != nil {
+		slog.Warn("could not load coin metadata", "event", "db_error", "error", err)
+		return nil
+	}
+	var missing []string
+	for _, id := range ids {
+		if _, ok := meta[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return meta
+	}
+	list, err := fetchCoinList(ctx, cfg)
+	if err != nil {
+		slog.Warn("could not look up coin symbols, using ids", "event", "coin_meta_error", "coins", missing, "error", err)
+		return meta
+	}
+	byID := map[string]coinMeta{}
+	for _, m := range list {
+		byID[m.ID] = m
+	}
+	var unknown []string
+	for _, id := range missing {
+		if m, ok := byID[id]; ok {
+			meta[id] = m
+		} else {
+			unknown = append(unknown, id)
+			list = append(list, coinMeta{ID: id})
+		}
+	}
+	if err := saveCoinMeta(ctx, db, list); err != nil {
+		slog.Warn("could not save coin metadata", "event", "db_error", "error", err)
+	}
+	slog.Info("coin list fetched", "event", "coin_meta", "coins", len(byID), "resolved", len(missing)-len(unknown))
+	if len(unknown) > 0 {
+		slog.Warn("coins not in CoinGecko's coin list, using ids", "event", "coin_meta_error", "coins", unknown)
+	}
+	return meta
+}
+
+// withCoinMeta sets the symbol of every coin without a configured one from
+// meta, uppercased like the built-in symbols.
+func withCoinMeta(coins []CoinSpec, meta map[string]coinMeta) []CoinSpec {
+	out := make([]CoinSpec, len(coins))
+	for i, c := range coins {
+		if m, ok := meta[c.ID]; ok && c.autoSymbol && m.Symbol != "" {
+			c.Symbol = strings.ToUpper(m.Symbol)
+		}
+		out[i] = c
+	}
+	return out
+}
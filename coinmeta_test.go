@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResolveCoinMetaRemembersUnknown(t *testing.T) {
+	clock := fixClock(t, time.Date(2026, 1, 2, 8, 0, 0, 0, time.UTC))
+	db := openTestDB(t)
+	var downloads int
+	stubCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/coins/list" {
+			t.Errorf("unexpected request for %s", r.URL.Path)
+		}
+		downloads++
+		w.Write([]byte(`[{"id":"bitcoin","symbol":"btc","name":"Bitcoin"}]`))
+	})
+	cfg := Config{Coins: []CoinSpec{{ID: "bitcoin", autoSymbol: true}, {ID: "no-such-coin", autoSymbol: true}}}
+	ctx := context.Background()
+
+	resolve := func() []CoinSpec { return withCoinMeta(cfg.Coins, resolveCoinMeta(ctx, cfg, db)) }
+	if got := resolve(); got[0].Symbol != "BTC" || got[1].Symbol != "" {
+		t.Fatalf("symbols %q, %q; want BTC and none", got[0].Symbol, got[1].Symbol)
+	}
+	if downloads != 1 {
+		t.Fatalf("%d coin list downloads, want 1", downloads)
+	}
+
+	// A restart within coinMetaRetry knows the unknown coin is unknown.
+	*clock = clock.Add(coinMetaRetry - time.Minute)
+	if got := resolve(); got[0].Symbol != "BTC" {
+		t.Errorf("symbol %q after restart, want BTC", got[0].Symbol)
+	}
+	if downloads != 1 {
+		t.Errorf("%d coin list downloads after restart, want still 1", downloads)
+	}
+
+	// Once it has expired the list is checked again.
+	*clock = clock.Add(2 * time.Minute)
+	resolve()
+	if downloads != 2 {
+		t.Errorf("%d coin list downloads after coinMetaRetry, want 2", downloads)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// captureLog sends slog output to a buffer until the test ends. The
+// returned func decodes the entries logged so far with the given event.
+func captureLog(t *testing.T) func(event string) []map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return func(event string) []map[string]any {
+		var out []map[string]any
+		for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			var e map[string]any
+			if json.Unmarshal(line, &e) == nil && e["event"] == event {
+				out = append(out, e)
+			}
+		}
+		return out
+	}
+}
+
+// readConfigFile writes body to a config file and reads it back.
+func readConfigFile(t *testing.T, body string) (Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return readConfig(path)
+}
+
+// loadTestConfig reads and validates a config file holding body.
+func loadTestConfig(t *testing.T, body string) (Config, error) {
+	t.Helper()
+	cfg, err := readConfigFile(t, body)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, validateConfig(cfg)
+}
+
+// hasProblem reports whether err lists a config problem containing substr.
+func hasProblem(err error, substr string) bool {
+	if err == nil {
+		return false
+	}
+	for _, p := range configProblems(err) {
+		if strings.Contains(p, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConfigHTTPProxy(t *testing.T) {
+	tests := []struct {
+		proxy string
+		ok    bool
+	}{
+		{"http://proxy.internal:3128", true},
+		{"proxy.internal:3128", false},
+		{"http://", false},
+		{"http://[::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proxy, func(t *testing.T) {
+			_, err := loadTestConfig(t, `{"http_proxy": "`+tt.proxy+`"}`)
+			if got := !hasProblem(err, "http_proxy"); got != tt.ok {
+				t.Errorf("http_proxy %q accepted = %v, want %v (err: %v)", tt.proxy, got, tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestDedupeCoins(t *testing.T) {
+	coins := []CoinSpec{{ID: "bitcoin", Symbol: "BTC"}, {ID: "ethereum"}, {ID: "bitcoin", Symbol: "XBT"}, {ID: "solana"}, {ID: "ethereum"}}
+	got, dups := dedupeCoins(coins)
+	want := []CoinSpec{{ID: "bitcoin", Symbol: "BTC"}, {ID: "ethereum"}, {ID: "solana"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dedupeCoins kept %+v, want %+v", got, want)
+	}
+	if !reflect.DeepEqual(dups, []string{"bitcoin", "ethereum"}) {
+		t.Errorf("dropped %v, want [bitcoin ethereum]", dups)
+	}
+
+	t.Run("config load warns", func(t *testing.T) {
+		logged := captureLog(t)
+		cfg, err := readConfigFile(t, `{"coins": [{"id": "bitcoin", "symbol": "BTC"}, {"id": "ethereum"}, {"id": "bitcoin", "symbol": "XBT"}]}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := coinIDs(cfg.Coins); !reflect.DeepEqual(ids, []string{"bitcoin", "ethereum"}) || cfg.Coins[0].Symbol != "BTC" {
+			t.Errorf("coins = %+v, want bitcoin (BTC) then ethereum", cfg.Coins)
+		}
+		warns := logged("config_duplicate_coins")
+		if len(warns) != 1 || !reflect.DeepEqual(warns[0]["coins"], []any{"bitcoin"}) || warns[0]["level"] != "WARN" {
+			t.Errorf("logged %v, want one warning naming bitcoin", warns)
+		}
+	})
+}
+
+func TestParseCoinList(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr string
+	}{
+		{"bitcoin", []string{"bitcoin"}, ""},
+		{" bitcoin , solana,cardano ", []string{"bitcoin", "solana", "cardano"}, ""},
+		{"bitcoin,solana,bitcoin", []string{"bitcoin", "solana"}, ""},
+		{"bitcoin,,solana", nil, "entry 2 is empty"},
+		{"", nil, "entry 1 is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseCoinList(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCoinList(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectCoins(t *testing.T) {
+	two := 2
+	configured := []CoinSpec{{ID: "bitcoin", Symbol: "BTC", Decimals: &two}, {ID: "ethereum", Symbol: "ETH"}}
+	got := selectCoins([]string{"solana", "bitcoin"}, configured)
+	want := []CoinSpec{{ID: "solana", Symbol: "SOLANA", autoSymbol: true}, {ID: "bitcoin", Symbol: "BTC", Decimals: &two}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("selectCoins = %+v, want %+v", got, want)
+	}
+}
+
+func TestConfigRetries(t *testing.T) {
+	tests := []struct {
+		body string
+		ok   bool
+	}{
+		{`{"max_retries": 0, "base_backoff_ms": 0}`, true},
+		{`{"max_retries": 50, "base_backoff_ms": 250}`, true},
+		{`{"max_retries": -1}`, false},
+		{`{"base_backoff_ms": -100}`, false},
+	}
+	for _, tt := range tests {
+		_, err := loadTestConfig(t, tt.body)
+		if got := !hasProblem(err, "max_retries and base_backoff_ms"); got != tt.ok {
+			t.Errorf("%s accepted = %v, want %v (err: %v)", tt.body, got, tt.ok, err)
+		}
+	}
+}
+
+func TestReadConfigDefaultCoins(t *testing.T) {
+	cfg, err := readConfigFile(t, `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := coinIDs(cfg.Coins); !reflect.DeepEqual(ids, coinIDs(defaultCoins)) {
+		t.Fatalf("coins = %v, want the defaults", ids)
+	}
+	// The config must own its coins; changing them can't touch the defaults
+	// a later reload starts from.
+	cfg.Coins[0].Symbol = "XBT"
+	if defaultCoins[0].Symbol != "BTC" {
+		t.Errorf("defaultCoins[0].Symbol = %q after editing a loaded config", defaultCoins[0].Symbol)
+	}
+}
+
+func TestConfigDebounceAndJitter(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"both valid", `{"interval_seconds": 600, "debounce_seconds": 60, "interval_jitter": 10}`, nil},
+		{"both invalid", `{"interval_seconds": 600, "debounce_seconds": -1, "interval_jitter": 60}`, []string{"debounce_seconds must be >= 0", "interval_jitter must be"}},
+		{"jitter invalid alone", `{"interval_seconds": 600, "interval_jitter": -5}`, []string{"interval_jitter must be"}},
+		{"debounce past the jittered interval", `{"interval_seconds": 600, "debounce_seconds": 500, "interval_jitter": 20}`, []string{"shortest jittered interval"}},
+		{"bad interval still checks jitter", `{"interval_seconds": 1, "interval_jitter": 50}`, []string{"interval_jitter must be"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, tt.body)
+			for _, want := range tt.want {
+				if !hasProblem(err, want) {
+					t.Errorf("no %q problem in %v", want, err)
+				}
+			}
+			if tt.want == nil && (hasProblem(err, "debounce_seconds") || hasProblem(err, "interval_jitter")) {
+				t.Errorf("unexpected problems: %v", err)
+			}
+		})
+	}
+}
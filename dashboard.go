@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+// === DASHBOARD ===
+
+//go:embed dashboard.html
+var dashboardFS embed.FS
+
+// dashboardTemplate is a single page that follows /ws (polling /latest
+// while it is down) and charts the last 24h of the selected coin from
+// /history.
+var dashboardTemplate = template.Must(template.ParseFS(dashboardFS, "dashboard.html"))
+
+// handleDashboard serves GET / when EnableDashboard is set, and 404 otherwise.
+// The page refreshes once per poll interval, charting the first currency
+// with the axis labels in the configured number style.
+func (s *server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	if !cfg.EnableDashboard {
+		http.NotFound(w, r)
+		return
+	}
+	interval, _ := pollInterval(cfg)
+	var b bytes.Buffer
+	err := dashboardTemplate.Execute(&b, struct {
+		RefreshSeconds int
+		Currency       string
+		Number         numberStyle
+	}{int(interval.Seconds()), cfg.Currencies[0], configNumberStyle(cfg)})
+	if err != nil {
+		slog.Error("dashboard render failed", "event", "http_render_error", "error", err)
+		writeError(w, http.StatusInternalServerError, "render failed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // Postgres driver, registered as "pgx"
+	_ "modernc.org/sqlite"             // SQLite driver (no CGO)
+)
+
+// === DATABASE ===
+
+// dbDrivers are the accepted values of Config.DBDriver.
+var dbDrivers = []string{"sqlite", "postgres"}
+
+// DB is a *sql.DB that lets queries be written once with SQLite's ?
+// placeholders; on Postgres they are rewritten to $1, $2, ... before they
+// reach the driver.
+type DB struct {
+	*sql.DB
+	postgres bool
+}
+
+// rebind rewrites ? placeholders for the driver. Queries must not contain a
+// literal ? in a string.
+func (db *DB) rebind(query string) string {
+	if !db.postgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.rebind(query), args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, db.rebind(query), args...)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, db.rebind(query), args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return db.DB.QueryRowContext(ctx, db.rebind(query), args...)
+}
+
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, db: db}, nil
+}
+
+// Tx is a *sql.Tx that rebinds placeholders like DB.
+type Tx struct {
+	*sql.Tx
+	db *DB
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return tx.Tx.ExecContext(ctx, tx.db.rebind(query), args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(ctx, tx.db.rebind(query), args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRowContext(ctx, tx.db.rebind(query), args...)
+}
+
+func (tx *Tx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return tx.Tx.PrepareContext(ctx, tx.db.rebind(query))
+}
+
+// openDB opens and migrates the database cfg.DBDriver selects.
+func openDB(cfg Config) (*DB, error) {
+	switch cfg.DBDriver {
+	case "postgres":
+		return initPostgres(cfg.DBDSN)
+	default:
+		return initDB(cfg.DBPath)
+	}
+}
+
+// === DATABASE INIT ===
+func initDB(path string) (*DB, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	db, err := openSQLite(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openSQLite opens the SQLite file at path as is, read-only if asked.
+func openSQLite(path string, readOnly bool) (*DB, error) {
+	sqlDB, err := sql.Open("sqlite", sqliteDSN(path, readOnly))
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{DB: sqlDB}
+	var journalMode string
+	var busyTimeout int
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout); err != nil {
+		db.Close()
+		return nil, err
+	}
+	slog.Info("sqlite opened", "event", "db_open", "path", path, "read_only", readOnly, "journal_mode", journalMode, "busy_timeout_ms", busyTimeout)
+	return db, nil
+}
+
+// sqliteDSN is path as a file: URI, escaped so a ? or # in it stays part of
+// the name. Pragmas in the DSN are applied by the driver on every new
+// connection, which matters for busy_timeout since it is per-connection
+// state. A read-only DSN leaves the journal mode as the file has it.
+func sqliteDSN(path string, readOnly bool) string {
+	q := url.Values{"_pragma": {"journal_mode(WAL)", "busy_timeout(5000)"}}
+	if readOnly {
+		q = url.Values{"mode": {"ro"}, "_pragma": {"busy_timeout(5000)"}}
+	}
+	u := url.URL{Scheme: "file", Path: path, OmitHost: true, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// openDBReadOnly opens the existing database cfg.DBDriver selects for an
+// offline read such as --status: nothing is created or migrated, and a
+// database that isn't at the current schema version is an error.
+func openDBReadOnly(cfg Config) (*DB, error) {
+	var db *DB
+	var err error
+	switch cfg.DBDriver {
+	case "postgres":
+		db, err = connectPostgres(cfg.DBDSN)
+	default:
+		if _, err := os.Stat(cfg.DBPath); errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("no database at %s", cfg.DBPath)
+		} else if err != nil {
+			return nil, err
+		}
+		db, err = openSQLite(cfg.DBPath, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// vacuumSQLite rewrites the database file so the space pruning freed is
+// returned to the OS, checkpoints the WAL into it and refreshes the planner
+// statistics, logging the size of the files before and after. It is meant
+// to run as a one-off command: a tracker still running against the same
+// file just waits on the lock, or the vacuum fails with SQLITE_BUSY after
+// busy_timeout, rather than anything being lost.
+func vacuumSQLite(ctx context.Context, cfg Config, db *DB) error {
+	if db.postgres {
+		return errors.New("--vacuum only applies to SQLite; Postgres reclaims space with autovacuum or VACUUM FULL")
+	}
+	before := sqliteSize(cfg.DBPath)
+	for _, stmt := range []string{"VACUUM", "PRAGMA wal_checkpoint(TRUNCATE)", "PRAGMA optimize"} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	after := sqliteSize(cfg.DBPath)
+	slog.Info("database vacuumed", "event", "db_vacuum", "path", cfg.DBPath, "bytes_before", before, "bytes_after", after, "bytes_freed", before-after)
+	return nil
+}
+
+// sqliteSize is the size of the database file plus its WAL, or 0 for files
+// that don't exist.
+func sqliteSize(path string) int64 {
+	var total int64
+	for _, p := range []string{path, path + "-wal"} {
+		if fi, err := os.Stat(p); err == nil {
+			total += fi.Size()
+		}
+	}
+	return total
+}
+
+// initPostgres connects to dsn and migrates it to the same tables as
+// initDB. created_at columns are TIMESTAMP (without time zone) holding UTC,
+// which is what the sqliteTime strings used as query parameters parse to.
+func initPostgres(dsn string) (*DB, error) {
+	db, err := connectPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// connectPostgres connects to dsn without migrating.
+func connectPostgres(dsn string) (*DB, error) {
+	sqlDB, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{DB: sqlDB, postgres: true}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	slog.Info("postgres opened", "event", "db_open", "driver", "postgres")
+	return db, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+)
+
+// === DENOMINATED PRICES ===
+
+// denominationLabel is the currency code prices denominated in coin are
+// stored and shown under: its lowercased symbol, e.g. "btc".
+func denominationLabel(coins []CoinSpec, id string) string {
+	return strings.ToLower(coinSymbol(coinByID(coins, id)))
+}
+
+// denominationLabels returns the labels of cfg.DenominateIn, in order.
+func denominationLabels(cfg Config) []string {
+	var out []string
+	for _, id := range cfg.DenominateIn {
+		out = append(out, denominationLabel(cfg.Coins, id))
+	}
+	return out
+}
+
+// displayCurrencies is cfg.Currencies followed by the denomination labels:
+// every currency a job stores and shows prices in.
+func displayCurrencies(cfg Config) []string {
+	return append(slices.Clip(cfg.Currencies), denominationLabels(cfg)...)
+}
+
+// denominate adds to prices each coin's price in every cfg.DenominateIn
+// coin, as the ratio of their prices in the first configured currency.
+// The denominator itself is skipped, as is a denominator whose price is
+// missing or zero this fetch.
+func denominate(cfg Config, prices map[string]map[string]float64) {
+	cur := cfg.Currencies[0]
+	for _, id := range cfg.DenominateIn {
+		div := prices[id][cur]
+		if div <= 0 {
+			slog.Warn("denominated prices skipped: no price for denominator", "event", "denominate_skipped", "coin", id, "currency", cur)
+			continue
+		}
+		label := denominationLabel(cfg.Coins, id)
+		for coin, byCur := range prices {
+			price, ok := byCur[cur]
+			if coin == id || !ok {
+				continue
+			}
+			byCur[label] = price / div
+		}
+	}
+}
+
+// ratioSignificantDigits is how many digits a denominated price is shown with.
+const ratioSignificantDigits = 4
+
+// ratioDecimals is the precision for a denominated price v, e.g. 0.05312
+// BTC; ratios are mostly well below 1, where two decimals say little.
+func ratioDecimals(v float64) int {
+	a := math.Abs(v)
+	if a == 0 {
+		return 2
+	}
+	return max(0, min(ratioSignificantDigits-1-int(math.Floor(math.Log10(a))), maxDecimals))
+}
+
+// priceDecimals is the precision to show coin's price v in cur with:
+// ratioDecimals for a denomination label unless the coin sets Decimals,
+// the coin's own precision otherwise.
+func priceDecimals(cfg Config, c CoinSpec, cur string, v float64) int {
+	if c.Decimals == nil && slices.Contains(denominationLabels(cfg), cur) {
+		return ratioDecimals(v)
+	}
+	return c.decimals(v)
+}
+
+// validateDenominations rejects DenominateIn entries that aren't tracked
+// coins or whose label clashes with a configured currency.
+func validateDenominations(ids []string, coins []CoinSpec, currencies []string) error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, id := range ids {
+		if !hasCoin(coins, id) {
+			errs = append(errs, fmt.Errorf("denominate_in[%d]: coin %q is not in coins", i, id))
+			continue
+		}
+		label := denominationLabel(coins, id)
+		if slices.Contains(currencies, label) || seen[label] {
+			errs = append(errs, fmt.Errorf("denominate_in[%d]: %q is already a currency", i, label))
+		}
+		seen[label] = true
+	}
+	return errors.Join(errs...)
+}
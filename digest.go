@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// === DAILY DIGEST ===
+
+// defaultDigestTime is when the digest goes out if DigestTime is unset.
+const defaultDigestTime = "08:00"
+
+// digestClock returns DigestTime, or its default, in minutes after midnight.
+func digestClock(cfg Config) int {
+	at := cfg.DigestTime
+	if at == "" {
+		at = defaultDigestTime
+	}
+	m, err := parseClock(at)
+	if err != nil {
+		// The config is validated at startup; this only guards a bad reload.
+		m, _ = parseClock(defaultDigestTime)
+	}
+	return m
+}
+
+// untilDigest returns how long from now until the next DigestTime in the
+// display zone. Building the time from the date keeps it right across DST.
+func untilDigest(cfg Config, now time.Time) time.Duration {
+	loc := displayLocation(cfg)
+	local := now.In(loc)
+	m := digestClock(cfg)
+	next := time.Date(local.Year(), local.Month(), local.Day(), m/60, m%60, 0, 0, loc)
+	if !next.After(local) {
+		next = time.Date(local.Year(), local.Month(), local.Day()+1, m/60, m%60, 0, 0, loc)
+	}
+	return next.Sub(now)
+}
+
+// dayRange is one coin's prices over a digest's window.
+type dayRange struct {
+	Open, High, Low, Close float64
+	Count                  int
+}
+
+// loadDayRange summarizes the stored prices of coin in currency between from
+// and to. ok is false when there are none.
+func loadDayRange(db *DB, coin, currency string, from, to time.Time) (r dayRange, ok bool, err error) {
+	rows, err := db.Query(`SELECT price_usd FROM prices
+		WHERE coin = ? AND currency = ? AND created_at >= ? AND created_at <= ?
+		ORDER BY created_at ASC`,
+		coin, currency, from.UTC().Format(sqliteTime), to.UTC().Format(sqliteTime))
+	if err != nil {
+		return dayRange{}, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var price float64
+		if err := rows.Scan(&price); err != nil {
+			return dayRange{}, false, err
+		}
+		if r.Count == 0 {
+			r = dayRange{Open: price, High: price, Low: price}
+		}
+		r.High = max(r.High, price)
+		r.Low = min(r.Low, price)
+		r.Close = price
+		r.Count++
+	}
+	return r, r.Count > 0, rows.Err()
+}
+
+// buildDigest is the recap of the 24 hours up to at: each active coin's
+// open, close, change, high and low in the first configured currency.
+// Coins with no prices stored in that window are left out; it returns ""
+// if that is all of them.
+func buildDigest(cfg Config, db *DB, at time.Time) (string, error) {
+	cur := cfg.Currencies[0]
+	from := at.Add(-24 * time.Hour)
+	var lines []string
+	for _, c := range activeCoins(cfg.Coins) {
+		r, ok, err := loadDayRange(db, c.ID, cur, from, at)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		d := c.decimals(r.Close)
+		line := fmt.Sprintf("%s: %s → %s", coinSymbol(c), formatFixed(cur, r.Open, d), formatFixed(cur, r.Close, d))
+		if r.Open != 0 {
+			line += " (" + formatPercent((r.Close-r.Open)/r.Open*100, 2) + ")"
+		}
+		line += fmt.Sprintf(" | H: %s L: %s", formatFixed(cur, r.High, d), formatFixed(cur, r.Low, d))
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("🗓 *Daily recap (%s)*\n24h to %s\n\n%s", strings.ToUpper(cur),
+		at.In(displayLocation(cfg)).Format(messageTime), strings.Join(lines, "\n")), nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// === JOB ===
+
+// job is the fetch/save/notify cycle main runs every interval, together with
+// the state carried from one run to the next. It only reaches the database
+// through store.
+type job struct {
+	cfg     Config
+	store   Store
+	sources []PriceSource
+	latest  *PriceCache
+	health  *jobHealth
+
+	maAlerts    *maTracker
+	priceAlerts *priceAlertTracker
+	cooldown    *alertCooldown
+	depegs      *depegTracker
+	lastPrices  map[string]map[string]float64
+	lastSaved   map[string]time.Time
+	lastRunAt   time.Time
+}
+
+// newJob returns a job for cfg that starts from the prices last saved to
+// store.
+func newJob(cfg Config, store Store, latest *PriceCache, health *jobHealth) *job {
+	lastPrices, err := store.Latest()
+	if err != nil {
+		slog.Warn("could not load last prices", "event", "db_error", "error", err)
+	}
+	return &job{
+		cfg:         cfg,
+		store:       store,
+		sources:     newPriceSources(cfg),
+		latest:      latest,
+		health:      health,
+		maAlerts:    newMATracker(),
+		priceAlerts: newPriceAlertTracker(),
+		cooldown:    newAlertCooldown(),
+		depegs:      newDepegTracker(),
+		lastPrices:  lastPrices,
+		lastSaved:   map[string]time.Time{},
+	}
+}
+
+// setConfig swaps in a reloaded config for the next run.
+func (j *job) setConfig(cfg Config) {
+	j.cfg = cfg
+	j.sources = newPriceSources(cfg)
+}
+
+// finishRun records how the fetch and save of a run went, both in
+// fetch_runs and for /healthz.
+func (j *job) finishRun(started time.Time, err error) {
+	run := fetchRun{StartedAt: started, DurationMs: now().Sub(started).Milliseconds(), OK: err == nil}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	j.health.recordRun(run)
+	if err := j.store.SaveRun(run); err != nil {
+		slog.Warn("could not record fetch run", "event", "db_error", "error", err)
+	}
+}
+
+// run does one fetch/save/notify cycle. It returns the fetch or save
+// error, or an error if the update reached no channel at all. A failed
+// save ends the cycle unless NotifyOnSaveError is set. Cancelling ctx
+// aborts the cycle wherever it is.
+func (j *job) run(ctx context.Context) error {
+	cfg := j.cfg
+	// Compare wall-clock times: the monotonic clock stops while the
+	// machine sleeps, so only the wall clock shows how long it was away.
+	// A clock that went backwards never debounces.
+	calledAt := time.Now().Round(0)
+	if !j.lastRunAt.IsZero() {
+		since := calledAt.Sub(j.lastRunAt)
+		if window := debounceWindow(cfg); since >= 0 && since < window {
+			slog.Info("run skipped: too soon after the previous one", "event", "job_debounced", "since_ms", since.Milliseconds(), "window_ms", window.Milliseconds())
+			return nil
+		}
+		if interval, _ := pollInterval(cfg); since > 2*interval {
+			slog.Info("catching up after a pause", "event", "job_catch_up", "since_ms", since.Milliseconds(), "interval_ms", interval.Milliseconds())
+		}
+	}
+	j.lastRunAt = calledAt
+
+	// Disabled coins are left out of the whole job; the HTTP API still
+	// serves their history.
+	cfg.Coins = activeCoins(cfg.Coins)
+
+	if cfg.RetryNotifications && !cfg.DryRun {
+		redeliverNotifications(ctx, cfg, j.store)
+	}
+	if !j.health.breaker.allow(now()) {
+		slog.Warn("price source circuit open, fetch skipped", "event", "breaker_skip", "sources", strings.Join(sourceNames(cfg), ","))
+		return errCircuitOpen
+	}
+	fetchTotal.Inc()
+	runStart := now()
+	start := runStart
+	res, err := fetchWithFallback(ctx, cfg, j.sources)
+	prices, market, missing := res.Prices, res.Market, res.Missing
+	fetchMs := now().Sub(start).Milliseconds()
+	if ctx.Err() == nil {
+		j.health.breaker.record(cfg, err, now())
+	}
+	if err != nil {
+		slog.Error("fetch failed", "event", "fetch_error", "sources", strings.Join(sourceNames(cfg), ","), "duration_ms", fetchMs, "error", err)
+		fetchErrorsTotal.Inc()
+		j.health.recordError(err)
+		j.finishRun(runStart, err)
+		return err
+	}
+	if len(missing) > 0 {
+		slog.Warn("some prices missing from response", "event", "fetch_partial", "missing", strings.Join(missing, ","))
+	}
+	recordPriceMetrics(prices)
+	for coin, byCur := range prices {
+		for cur, price := range byCur {
+			slog.Info("price", "event", "price", "coin", coin, "currency", cur, "price", price)
+		}
+	}
+	slog.Info("prices fetched", "event", "fetch_ok", "source", res.Source, "coins", len(prices), "duration_ms", fetchMs)
+
+	// From here on the denominated prices are handled like any other
+	// currency: stored, shown and served, though never alerted on.
+	denominate(cfg, prices)
+	cfg.Currencies = displayCurrencies(cfg)
+
+	fetchedAt := now()
+	j.health.recordSuccess(fetchedAt, res.Source)
+	records := priceRecords(cfg.Coins, cfg.Currencies, prices, market, res.Source, fetchedAt.Truncate(saveBucket(cfg)))
+	if cfg.SkipUnchanged {
+		heartbeat := defaultHeartbeat
+		if cfg.HeartbeatMinutes > 0 {
+			heartbeat = time.Duration(cfg.HeartbeatMinutes) * time.Minute
+		}
+		records = filterUnchanged(records, j.lastPrices, j.lastSaved, heartbeat)
+	}
+	start = now()
+	saveErr := j.store.Save(ctx, records)
+	j.health.recordSave(saveErr)
+	if saveErr != nil {
+		slog.Error("save failed", "event", "save_error", "rows", len(records), "error", saveErr)
+		j.finishRun(runStart, saveErr)
+		if !cfg.NotifyOnSaveError || ctx.Err() != nil {
+			return saveErr
+		}
+		slog.Warn("prices not saved, notifying anyway", "event", "save_error_notify")
+	} else {
+		slog.Info("prices saved", "event", "save_ok", "rows", len(records), "duration_ms", now().Sub(start).Milliseconds())
+		j.finishRun(runStart, nil)
+		for _, r := range records {
+			j.lastSaved[r.Coin+"/"+r.Currency] = r.FetchedAt
+		}
+	}
+
+	data := updateData(cfg, prices, j.lastPrices, dailyRanges(j.store, cfg.Coins, cfg.Currencies),
+		recentPriceSeries(j.store, cfg.Coins, cfg.Currencies, cfg.SparklineLength), market, fetchedAt)
+	if v, ok := valuePortfolio(cfg.Holdings, cfg.Coins, cfg.Currencies[0], prices, j.lastPrices, fetchedAt); ok {
+		data.Portfolio = &v
+		if err := j.store.SavePortfolio(v); err != nil {
+			slog.Warn("could not save portfolio value", "event", "db_error", "error", err)
+		}
+	}
+	msg := message{Text: formatMessage(cfg, data), Update: &data, Priority: priorityLow}
+	rules := activeAlerts(cfg)
+	moves := percentMoves(cfg.Coins, cfg.Currencies[0], rules.percent, prices, j.lastPrices)
+	moves = j.cooldown.filter(moves, time.Duration(cfg.AlertCooldownMinutes)*time.Minute, fetchedAt)
+	alert := formatAlert(cfg.Currencies[0], moves)
+	maAlert := formatMAAlert(j.maAlerts.evaluate(j.store, rules.ma, cfg.Coins, cfg.Currencies[0]))
+	priceAlert := formatPriceAlert(j.priceAlerts.evaluate(rules.price, cfg.Coins, cfg.Currencies[0], prices, j.lastPrices))
+	depegAlert := formatDepegAlert(j.depegs.evaluate(rules.pegs, cfg.Coins, prices))
+	update := sendUpdate(cfg, prices, j.lastPrices)
+	if update {
+		if err := sendWebhook(ctx, cfg, prices, j.lastPrices, fetchedAt); sendCanceled(ctx, err) {
+			slog.Info("notification canceled", "event", "notify_canceled", "channel", "webhook")
+		} else if err != nil {
+			slog.Error("notify failed", "event", "notify_error", "channel", "webhook", "error", err)
+			notifyErrorsTotal.WithLabelValues("webhook").Inc()
+		}
+	}
+	j.lastPrices = prices
+	j.latest.Set(prices, market, fetchedAt)
+	quiet := cfg.QuietHours.active(now(), displayLocation(cfg))
+	var notifyErr error
+	switch {
+	case !update:
+		slog.Info("regular update skipped", "event", "notify_skipped", "notify_mode", cfg.NotifyMode)
+	case quiet:
+		slog.Info("regular update held back for quiet hours", "event", "notify_quiet")
+	default:
+		notifyErr = notify(ctx, cfg, j.store, msg)
+	}
+	for _, a := range []struct{ kind, text string }{
+		{"depeg", depegAlert}, {"percent", alert}, {"ma", maAlert}, {"price", priceAlert},
+	} {
+		if a.text == "" {
+			continue
+		}
+		if quiet && !cfg.QuietHours.allows(a.kind) {
+			slog.Info("alert held back for quiet hours", "event", "notify_quiet", "alert", a.kind)
+			continue
+		}
+		if err := notify(ctx, cfg, j.store, message{Text: a.text, Priority: priorityHigh}); err != nil && ctx.Err() == nil {
+			slog.Error("alert not delivered on any channel", "event", "notify_undelivered", "error", err)
+		}
+	}
+	if notifyErr != nil {
+		if ctx.Err() == nil {
+			slog.Error("update not delivered on any channel", "event", "notify_undelivered", "error", notifyErr)
+		}
+		return notifyErr
+	}
+	if saveErr != nil {
+		return saveErr
+	}
+	slog.Info("Prices pushed successfully", "event", "job_ok")
+	return nil
+}
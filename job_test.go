@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixClock makes now() return *at until the test ends; advance it through
+// the returned pointer.
+func fixClock(t *testing.T, at time.Time) *time.Time {
+	t.Helper()
+	clock := at
+	old := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = old })
+	return &clock
+}
+
+// stubSource serves one price map per Fetch, repeating the last, or fails
+// with err when set.
+type stubSource struct {
+	prices []map[string]map[string]float64
+	err    error
+	calls  int
+}
+
+func (*stubSource) Name() string { return "stub" }
+
+func (s *stubSource) Fetch(_ context.Context, _ []CoinSpec, _ []string) (fetchResult, error) {
+	if s.err != nil {
+		return fetchResult{}, s.err
+	}
+	p := s.prices[min(s.calls, len(s.prices)-1)]
+	s.calls++
+	return fetchResult{Prices: p}, nil
+}
+
+// discordInbox is a stub Discord webhook that keeps every message posted.
+type discordInbox struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func newDiscordInbox(t *testing.T) (*discordInbox, string) {
+	t.Helper()
+	in := &discordInbox{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("discord body: %v", err)
+		}
+		in.mu.Lock()
+		in.messages = append(in.messages, body.Content)
+		in.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return in, srv.URL
+}
+
+func (in *discordInbox) take() []string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	out := in.messages
+	in.messages = nil
+	return out
+}
+
+func TestJobRun(t *testing.T) {
+	clock := fixClock(t, time.Date(2026, 1, 2, 8, 0, 0, 0, time.UTC))
+	inbox, webhook := newDiscordInbox(t)
+	cfg := Config{
+		Coins:                 []CoinSpec{{ID: "bitcoin", Symbol: "BTC"}},
+		Currencies:            []string{"usd"},
+		DiscordWebhook:        webhook,
+		AlertThresholdPercent: 5,
+	}
+	store := newMemStore()
+	latest := newPriceCache(time.Hour)
+	src := &stubSource{prices: []map[string]map[string]float64{
+		{"bitcoin": {"usd": 100}},
+		{"bitcoin": {"usd": 110}},
+	}}
+	job := newJob(cfg, store, latest, &jobHealth{breaker: newCircuitBreaker()})
+	job.sources = []PriceSource{src}
+	ctx := context.Background()
+
+	// First run: saved, cached and sent, with nothing to alert on yet.
+	if err := job.run(ctx); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	want := PriceRecord{Coin: "bitcoin", Currency: "usd", Price: 100, FetchedAt: *clock, Source: "stub"}
+	if len(store.records) != 1 || store.records[0] != want {
+		t.Fatalf("stored %+v, want [%+v]", store.records, want)
+	}
+	if got := latest.GetAll().Prices["bitcoin"]["usd"]; got != 100 {
+		t.Errorf("cached price %v, want 100", got)
+	}
+	msgs := inbox.take()
+	if len(msgs) != 1 || !strings.Contains(msgs[0], "BTC: $100.00") || !strings.Contains(msgs[0], "2026-01-02 08:00:00 UTC") {
+		t.Fatalf("first run sent %q, want one update with BTC at $100.00", msgs)
+	}
+
+	// A 10% move ten minutes later also sends the percent alert.
+	*clock = clock.Add(10 * time.Minute)
+	job.lastRunAt = time.Time{}
+	if err := job.run(ctx); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if len(store.records) != 2 {
+		t.Errorf("%d records stored, want 2", len(store.records))
+	}
+	msgs = inbox.take()
+	if len(msgs) != 2 || !strings.Contains(msgs[0], "Change: 10.00$") || !strings.Contains(msgs[1], "ALERT: price moved more than 5.00%") {
+		t.Fatalf("second run sent %q, want the update and a percent alert", msgs)
+	}
+
+	// A failed fetch sends nothing and is recorded as a failed run.
+	src.err = errors.New("upstream down")
+	job.lastRunAt = time.Time{}
+	if err := job.run(ctx); !errors.Is(err, src.err) {
+		t.Fatalf("third run returned %v, want %v", err, src.err)
+	}
+	if msgs := inbox.take(); len(msgs) != 0 {
+		t.Errorf("failed run sent %q", msgs)
+	}
+	if run := store.runs[len(store.runs)-1]; run.OK || run.Error != "upstream down" {
+		t.Errorf("last run recorded as %+v, want a failure", run)
+	}
+}
@@ -1,213 +1,1211 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
-
-	_ "modernc.org/sqlite" // SQLite driver (no CGO)
 )
 
 var (
-	dbFile = "data.db"
+	// version is set at build time with -ldflags "-X main.version=...".
+	version = "dev"
+
+	// httpClient is used for every outbound request so none can hang forever.
+	httpClient = &http.Client{Timeout: defaultHTTPTimeout}
+
+	// now is the clock behind every time that ends up in a message, a stored
+	// row or a response, so tests can fix it. Scheduling and rate limiting
+	// run on timers and keep reading the real clock.
+	now = time.Now
+)
+
+const (
+	defaultDBPath = "data.db"
+	// sqliteTime is how CURRENT_TIMESTAMP renders created_at (UTC). Rows are
+	// inserted with an explicit UTC time in the same layout, so old and new
+	// rows compare correctly as strings. Postgres parses the same strings
+	// into its TIMESTAMP columns.
+	sqliteTime = "2006-01-02 15:04:05"
+
+	pruneInterval = 24 * time.Hour
+
+	defaultHTTPTimeout = 10 * time.Second
+	shutdownTimeout    = 5 * time.Second
+)
+
+// === STORE TO DB ===
+
+// PriceRecord is a single observed price: one coin in one currency at the
+// time it was fetched. It is the canonical shape for stored prices.
+type PriceRecord struct {
+	Coin      string    `json:"coin"`
+	Currency  string    `json:"currency"`
+	Price     float64   `json:"price"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// Source is the price source the row came from.
+	Source string `json:"source,omitempty"`
+	marketData
+}
+
+// priceRecords flattens a fetch result from source into records, in config
+// order.
+func priceRecords(coins []CoinSpec, currencies []string, prices map[string]map[string]float64, market map[string]map[string]marketData, source string, at time.Time) []PriceRecord {
+	var out []PriceRecord
+	for _, c := range coins {
+		for _, cur := range currencies {
+			if price, ok := prices[c.ID][cur]; ok {
+				out = append(out, PriceRecord{Coin: c.ID, Currency: cur, Price: price, FetchedAt: at, Source: source, marketData: market[c.ID][cur]})
+			}
+		}
+	}
+	return out
+}
+
+const defaultHeartbeat = time.Hour
+
+// filterUnchanged drops records whose price equals lastPrices, unless that
+// coin/currency hasn't been written for at least heartbeat. lastSaved is
+// keyed by "coin/currency"; a key with no entry is always written.
+func filterUnchanged(records []PriceRecord, lastPrices map[string]map[string]float64, lastSaved map[string]time.Time, heartbeat time.Duration) []PriceRecord {
+	var out []PriceRecord
+	for _, r := range records {
+		last, seen := lastPrices[r.Coin][r.Currency]
+		saved, ok := lastSaved[r.Coin+"/"+r.Currency]
+		if seen && ok && last == r.Price && r.FetchedAt.Sub(saved) < heartbeat {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// pricesChanged reports whether any price differs from lastPrices, counting
+// a coin or currency with no previous price as a change.
+func pricesChanged(prices, lastPrices map[string]map[string]float64) bool {
+	for coin, byCur := range prices {
+		for cur, price := range byCur {
+			if last, ok := lastPrices[coin][cur]; !ok || last != price {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sendUpdate reports whether NotifyMode wants the regular update (and the
+// webhook) sent for this fetch.
+func sendUpdate(cfg Config, prices, lastPrices map[string]map[string]float64) bool {
+	switch cfg.NotifyMode {
+	case "alertsonly":
+		return false
+	case "onchange":
+		return pricesChanged(prices, lastPrices)
+	}
+	return true
+}
+
+// saveBucket is the width stored price times are rounded down to; 0 (the
+// default) leaves them alone.
+func saveBucket(cfg Config) time.Duration {
+	return time.Duration(cfg.SaveBucketSeconds) * time.Second
+}
+
+const (
+	insertPriceSQL = "INSERT INTO prices (coin, currency, price_usd, created_at, market_cap, volume_24h, change_24h, source) VALUES "
+	// upsertPriceSQL follows the VALUES so a row already stored for the same
+	// coin, currency and time is overwritten rather than duplicated.
+	upsertPriceSQL = " ON CONFLICT (coin, currency, created_at) DO UPDATE SET price_usd = excluded.price_usd," +
+		" market_cap = excluded.market_cap, volume_24h = excluded.volume_24h, change_24h = excluded.change_24h, source = excluded.source"
+	priceRowParams = 8
+	// maxSQLParams is SQLite's historical SQLITE_MAX_VARIABLE_NUMBER. Batches
+	// that would need more bind parameters are inserted row by row instead.
+	maxSQLParams = 999
 )
 
-type Config struct {
-	TelegramToken  string `json:"telegram_token"`
-	TelegramChatID string `json:"telegram_chat_id"`
-	SlackWebhook   string `json:"slack_webhook"`
+// savePrices stores records in one transaction, as a single multi-row INSERT
+// when the batch fits within SQLite's parameter limit.
+func savePrices(ctx context.Context, db *DB, records []PriceRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if len(records)*priceRowParams <= maxSQLParams {
+		err = insertPricesBatch(ctx, tx, records)
+	} else {
+		err = insertPricesEach(ctx, tx, records)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertPricesBatch(ctx context.Context, tx *Tx, records []PriceRecord) error {
+	var sb strings.Builder
+	sb.WriteString(insertPriceSQL)
+	args := make([]any, 0, len(records)*priceRowParams)
+	for i, r := range records {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, r.Coin, r.Currency, r.Price, r.FetchedAt.UTC().Format(sqliteTime), r.MarketCap, r.Volume24h, r.Change24h, r.Source)
+	}
+	sb.WriteString(upsertPriceSQL)
+	_, err := tx.ExecContext(ctx, sb.String(), args...)
+	return err
 }
 
-func loadConfig() Config {
-	data, err := os.ReadFile("config.json")
+func insertPricesEach(ctx context.Context, tx *Tx, records []PriceRecord) error {
+	stmt, err := tx.PrepareContext(ctx, insertPriceSQL+"(?, ?, ?, ?, ?, ?, ?, ?)"+upsertPriceSQL)
 	if err != nil {
-		log.Fatalf("Không đọc được config.json: %v", err)
+		return err
 	}
-	var cfg Config
-	json.Unmarshal(data, &cfg)
-	return cfg
+	defer stmt.Close()
+
+	for _, r := range records {
+		if _, err := stmt.ExecContext(ctx, r.Coin, r.Currency, r.Price, r.FetchedAt.UTC().Format(sqliteTime), r.MarketCap, r.Volume24h, r.Change24h, r.Source); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-var coins = []string{"bitcoin", "ethereum", "binancecoin"}
+// savePricesIfAbsent stores records in one transaction, skipping any that
+// already have a row for the same coin, currency and second. It returns how
+// many rows were inserted.
+func savePricesIfAbsent(ctx context.Context, db *DB, records []PriceRecord) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// A separate existence check rather than INSERT ... SELECT ? WHERE NOT
+	// EXISTS, since Postgres can't infer column types for bare parameters.
+	exists, err := tx.PrepareContext(ctx, `SELECT COUNT(*) FROM prices WHERE coin = ? AND currency = ? AND created_at = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer exists.Close()
+	insert, err := tx.PrepareContext(ctx, "INSERT INTO prices (coin, currency, price_usd, created_at, source) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
 
-type PriceResponse map[string]map[string]float64
+	inserted := 0
+	for _, r := range records {
+		at := r.FetchedAt.UTC().Format(sqliteTime)
+		var n int
+		if err := exists.QueryRowContext(ctx, r.Coin, r.Currency, at).Scan(&n); err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := insert.ExecContext(ctx, r.Coin, r.Currency, r.Price, at, r.Source); err != nil {
+			return 0, err
+		}
+		inserted++
+	}
+	return inserted, tx.Commit()
+}
 
-// === DATABASE INIT ===
-func initDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite", dbFile)
+// loadLastPrices returns the most recent stored price per coin and currency,
+// so change lines and alerts survive a restart. An empty table yields an
+// empty map.
+func loadLastPrices(db *DB) (map[string]map[string]float64, error) {
+	records, err := loadLatestRecords(db)
 	if err != nil {
 		return nil, err
 	}
-	createTable := `
-	CREATE TABLE IF NOT EXISTS prices (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		coin TEXT NOT NULL,
-		price_usd REAL NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	`
-	if _, err := db.Exec(createTable); err != nil {
-		return nil, err
+	out := map[string]map[string]float64{}
+	for _, r := range records {
+		if out[r.Coin] == nil {
+			out[r.Coin] = map[string]float64{}
+		}
+		out[r.Coin][r.Currency] = r.Price
 	}
-	return db, nil
+	return out, nil
 }
 
-// === FETCH PRICES ===
-func fetchPrices() (map[string]float64, error) {
-	url := fmt.Sprintf("https://api.coingecko.com/api/v3/simple/price?ids=%s&vs_currencies=usd",
-		strings.Join(coins, ","),
-	)
-	resp, err := http.Get(url)
+// loadLatestRecords returns the newest stored row per coin and currency.
+func loadLatestRecords(db *DB) ([]PriceRecord, error) {
+	rows, err := db.Query(`SELECT p.coin, p.currency, p.price_usd, p.created_at FROM prices p
+		JOIN (SELECT coin, currency, MAX(created_at) AS at FROM prices GROUP BY coin, currency) l
+		ON p.coin = l.coin AND p.currency = l.currency AND p.created_at = l.at`)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("coingecko returned %d", resp.StatusCode)
+	defer rows.Close()
+
+	var out []PriceRecord
+	for rows.Next() {
+		var r PriceRecord
+		if err := rows.Scan(&r.Coin, &r.Currency, &r.Price, &r.FetchedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
 	}
+	return out, rows.Err()
+}
 
-	var data PriceResponse
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		return nil, err
+// dailyRange returns the highest and lowest stored price of coin in currency
+// over the last 24 hours, or over whatever shorter history exists. It returns
+// errNotEnoughHistory when there is nothing stored in that window.
+func dailyRange(db *DB, coin, currency string) (high, low float64, err error) {
+	since := now().Add(-24 * time.Hour).UTC().Format(sqliteTime)
+	var h, l sql.NullFloat64
+	err = db.QueryRow(`SELECT MAX(price_usd), MIN(price_usd) FROM prices
+		WHERE coin = ? AND currency = ? AND created_at >= ?`, coin, currency, since).Scan(&h, &l)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !h.Valid {
+		return 0, 0, errNotEnoughHistory
 	}
+	return h.Float64, l.Float64, nil
+}
+
+// errNotEnoughHistory means the stored prices don't cover the requested
+// window yet, so an average over it would be misleading.
+var errNotEnoughHistory = errors.New("not enough history")
 
-	out := map[string]float64{}
+// movingAverage returns the mean stored price of coin in currency over the
+// last window. It returns errNotEnoughHistory unless the oldest stored row
+// is at least window old.
+func movingAverage(db *DB, coin, currency string, window time.Duration) (float64, error) {
+	since := now().Add(-window).UTC().Format(sqliteTime)
+	var covered bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM prices WHERE coin = ? AND currency = ? AND created_at <= ?)`,
+		coin, currency, since).Scan(&covered); err != nil {
+		return 0, err
+	}
+	if !covered {
+		return 0, errNotEnoughHistory
+	}
+	var avg sql.NullFloat64
+	if err := db.QueryRow(`SELECT AVG(price_usd) FROM prices
+		WHERE coin = ? AND currency = ? AND created_at >= ?`, coin, currency, since).Scan(&avg); err != nil {
+		return 0, err
+	}
+	if !avg.Valid {
+		return 0, errNotEnoughHistory
+	}
+	return avg.Float64, nil
+}
+
+// dailyRanges collects dailyRange for every coin and currency, skipping any
+// that have no history or fail to load.
+func dailyRanges(st Store, coins []CoinSpec, currencies []string) map[string]map[string]priceRange {
+	out := map[string]map[string]priceRange{}
 	for _, c := range coins {
-		if v, ok := data[c]["usd"]; ok {
-			out[c] = v
-		} else {
-			return nil, errors.New("missing usd for " + c)
+		for _, cur := range currencies {
+			high, low, err := st.DailyRange(c.ID, cur)
+			if errors.Is(err, errNotEnoughHistory) {
+				continue
+			}
+			if err != nil {
+				slog.Warn("24h range query failed", "event", "range_error", "coin", c.ID, "currency", cur, "error", err)
+				continue
+			}
+			if out[c.ID] == nil {
+				out[c.ID] = map[string]priceRange{}
+			}
+			out[c.ID][cur] = priceRange{High: high, Low: low}
 		}
 	}
-	return out, nil
+	return out
 }
 
-// === STORE TO DB ===
-func savePrices(db *sql.DB, prices map[string]float64) error {
-	tx, err := db.Begin()
+// recentPrices returns up to the last n stored prices of coin in currency,
+// oldest first.
+func recentPrices(db *DB, coin, currency string, n int) ([]float64, error) {
+	rows, err := db.Query(`SELECT price_usd FROM prices
+		WHERE coin = ? AND currency = ? ORDER BY created_at DESC LIMIT ?`, coin, currency, n)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []float64
+	for rows.Next() {
+		var p float64
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	slices.Reverse(out)
+	return out, rows.Err()
+}
+
+// recentPriceSeries collects recentPrices for every coin and currency,
+// skipping any that fail to load. It returns nil when n is 0.
+func recentPriceSeries(st Store, coins []CoinSpec, currencies []string, n int) map[string]map[string][]float64 {
+	if n <= 0 {
+		return nil
+	}
+	out := map[string]map[string][]float64{}
+	for _, c := range coins {
+		for _, cur := range currencies {
+			series, err := st.Recent(c.ID, cur, n)
+			if err != nil {
+				slog.Warn("recent prices query failed", "event", "sparkline_error", "coin", c.ID, "currency", cur, "error", err)
+				continue
+			}
+			if out[c.ID] == nil {
+				out[c.ID] = map[string][]float64{}
+			}
+			out[c.ID][cur] = series
+		}
+	}
+	return out
+}
+
+// fetchRun is the outcome of one job's fetch and save, kept in fetch_runs.
+type fetchRun struct {
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	OK         bool      `json:"ok"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func saveFetchRun(db *DB, run fetchRun) error {
+	var errText sql.NullString
+	if run.Error != "" {
+		errText = sql.NullString{String: run.Error, Valid: true}
 	}
-	stmt, err := tx.Prepare("INSERT INTO prices (coin, price_usd) VALUES (?, ?)")
+	_, err := db.Exec("INSERT INTO fetch_runs (started_at, duration_ms, ok, error) VALUES (?, ?, ?, ?)",
+		run.StartedAt.UTC().Format(sqliteTime), run.DurationMs, run.OK, errText)
+	return err
+}
+
+func savePortfolioValue(db *DB, v portfolioValue) error {
+	_, err := db.Exec("INSERT INTO portfolio_value (currency, value, created_at) VALUES (?, ?, ?)",
+		v.Currency, v.Value, v.At.UTC().Format(sqliteTime))
+	return err
+}
+
+// failedNotification is a message that a channel didn't accept, queued in
+// failed_notifications for redelivery.
+type failedNotification struct {
+	ID       int64
+	Channel  string
+	Text     string
+	Attempts int
+}
+
+func queueFailedNotification(db *DB, channel, text string, sendErr error) error {
+	_, err := db.Exec("INSERT INTO failed_notifications (channel, text, error, created_at) VALUES (?, ?, ?, ?)",
+		channel, text, sendErr.Error(), now().UTC().Format(sqliteTime))
+	return err
+}
+
+// loadFailedNotifications returns the queue oldest first.
+func loadFailedNotifications(db *DB) ([]failedNotification, error) {
+	rows, err := db.Query("SELECT id, channel, text, attempts FROM failed_notifications ORDER BY id")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer stmt.Close()
+	defer rows.Close()
 
-	for coin, price := range prices {
-		if _, err := stmt.Exec(coin, price); err != nil {
-			tx.Rollback()
-			return err
+	var out []failedNotification
+	for rows.Next() {
+		var f failedNotification
+		if err := rows.Scan(&f.ID, &f.Channel, &f.Text, &f.Attempts); err != nil {
+			return nil, err
 		}
+		out = append(out, f)
 	}
-	return tx.Commit()
+	return out, rows.Err()
 }
 
-// === TELEGRAM ===
-func sendTelegramMessage(cfg Config, text string) error {
-	if cfg.TelegramToken == "" || cfg.TelegramChatID == "" {
-		return errors.New("TELEGRAM_BOT_TOKEN or TELEGRAM_CHAT_ID not set")
+func recordRedeliveryAttempt(db *DB, id int64, sendErr error) error {
+	_, err := db.Exec("UPDATE failed_notifications SET attempts = attempts + 1, error = ? WHERE id = ?", sendErr.Error(), id)
+	return err
+}
+
+func deleteFailedNotification(db *DB, id int64) error {
+	_, err := db.Exec("DELETE FROM failed_notifications WHERE id = ?", id)
+	return err
+}
+
+// notificationAttempt is one send through one channel, as logged in the
+// notifications table. Status is "sent", "failed" or "canceled" (cut short
+// by shutdown).
+type notificationAttempt struct {
+	ID         int64     `json:"id"`
+	Channel    string    `json:"channel"`
+	Text       string    `json:"text"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	At         time.Time `json:"at"`
+}
+
+func logNotification(db *DB, a notificationAttempt) error {
+	var errText sql.NullString
+	if a.Error != "" {
+		errText = sql.NullString{String: a.Error, Valid: true}
 	}
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", cfg.TelegramToken)
-	body := fmt.Sprintf(`{"chat_id":"%s","text":%q}`, cfg.TelegramChatID, text)
-	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	_, err := db.Exec("INSERT INTO notifications (channel, text, status, error, duration_ms, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		a.Channel, a.Text, a.Status, errText, a.DurationMs, a.At.UTC().Format(sqliteTime))
+	return err
+}
+
+// loadNotifications returns up to the last limit logged attempts, newest first.
+func loadNotifications(ctx context.Context, db *DB, limit int) ([]notificationAttempt, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT id, channel, text, status, error, duration_ms, created_at FROM notifications ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []notificationAttempt{}
+	for rows.Next() {
+		var (
+			a       notificationAttempt
+			errText sql.NullString
+		)
+		if err := rows.Scan(&a.ID, &a.Channel, &a.Text, &a.Status, &errText, &a.DurationMs, &a.At); err != nil {
+			return nil, err
+		}
+		a.Error = errText.String
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// prunedTables are the tables pruneOld applies RetentionDays to.
+var prunedTables = []string{"prices", "notifications"}
+
+// pruneOld deletes rows of table older than olderThan and logs how many
+// were removed.
+func pruneOld(db *DB, table string, olderThan time.Duration) error {
+	cutoff := now().Add(-olderThan).UTC().Format(sqliteTime)
+	res, err := db.Exec("DELETE FROM "+table+" WHERE created_at < ?", cutoff)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	io.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("telegram returned %d", resp.StatusCode)
+	n, _ := res.RowsAffected()
+	slog.Info("pruned old rows", "event", "prune", "table", table, "rows", n, "cutoff", cutoff)
+	return nil
+}
+
+// backfill imports days days of CoinGecko history for coin in every
+// configured currency, whatever cfg.Source is, so moving averages and ranges
+// have data for a newly tracked coin. Rows already stored are left alone.
+func backfill(ctx context.Context, cfg Config, db *DB, coin string, days int) error {
+	for _, cur := range cfg.Currencies {
+		records, err := fetchMarketChart(ctx, cfg, coin, cur, days)
+		if err != nil {
+			return fmt.Errorf("backfill %s/%s: %w", coin, cur, err)
+		}
+		n, err := savePricesIfAbsent(ctx, db, records)
+		if err != nil {
+			return fmt.Errorf("backfill %s/%s: %w", coin, cur, err)
+		}
+		slog.Info("backfilled prices", "event", "backfill", "coin", coin, "currency", cur, "days", days, "fetched", len(records), "inserted", n)
 	}
 	return nil
 }
 
-// === SLACK ===
-func sendSlackMessage(cfg Config, text string) error {
-	if cfg.SlackWebhook == "" {
-		return nil
+// lastSuccessfulFetch returns when the newest successful fetch run started,
+// or ok=false if none is recorded.
+func lastSuccessfulFetch(db *DB) (at time.Time, ok bool, err error) {
+	err = db.QueryRow("SELECT started_at FROM fetch_runs WHERE ok = ? ORDER BY started_at DESC LIMIT 1", true).Scan(&at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
 	}
-	payload := map[string]string{"text": text}
-	body, _ := json.Marshal(payload)
-	resp, err := http.Post(cfg.SlackWebhook, "application/json", strings.NewReader(string(body)))
+	return at, err == nil, err
+}
+
+// printStatus writes the configured coins with their latest stored price in
+// every currency as an aligned table, followed by the last successful fetch.
+func printStatus(w io.Writer, cfg Config, db *DB) error {
+	records, err := loadLatestRecords(db)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	io.ReadAll(resp.Body)
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("slack returned %d", resp.StatusCode)
+	latest := map[string]PriceRecord{}
+	for _, r := range records {
+		latest[r.Coin+"/"+r.Currency] = r
 	}
-	return nil
+	loc := displayLocation(cfg)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COIN\tSYMBOL\tPRICE\tSTORED AT")
+	for _, c := range cfg.Coins {
+		id := c.ID
+		if !c.enabled() {
+			id += " (disabled)"
+		}
+		for _, cur := range displayCurrencies(cfg) {
+			price, at := "-", "-"
+			if r, ok := latest[c.ID+"/"+cur]; ok {
+				price = formatFixed(cur, r.Price, priceDecimals(cfg, c, cur, r.Price))
+				at = r.FetchedAt.In(loc).Format(messageTime)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", id, c.Symbol, price, at)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	at, ok, err := lastSuccessfulFetch(db)
+	if err != nil {
+		return err
+	}
+	last := "never"
+	if ok {
+		last = at.In(loc).Format(messageTime)
+	}
+	_, err = fmt.Fprintf(w, "\nLast successful fetch: %s\n", last)
+	return err
 }
 
-// === HELPER ===
-func formatMessage(prices map[string]float64, lastPrices map[string]float64) string {
-	now := time.Now().Format("2006-01-02 15:04:05")
-	msg := fmt.Sprintf("📊 *Crypto Prices (USD)*\nTime: %s\n", now)
-	for _, c := range coins {
-		symbol := map[string]string{
-			"bitcoin":     "BTC",
-			"ethereum":    "ETH",
-			"binancecoin": "BNB",
-		}[c]
-		msg += fmt.Sprintf("\n%s: $%.2f", symbol, prices[c])
-		if lastPrices[c] > 0 {
-			msg += fmt.Sprintf(" Change: %.2f$", prices[c]-lastPrices[c])
+// applyHTTPConfig sets up the shared outbound HTTP client and the CoinGecko
+// limiter from cfg, resetting anything left unset to its default.
+func applyHTTPConfig(cfg Config) {
+	httpClient.Timeout = defaultHTTPTimeout
+	if cfg.HTTPTimeoutSeconds > 0 {
+		httpClient.Timeout = time.Duration(cfg.HTTPTimeoutSeconds) * time.Second
+	}
+	agent := cfg.UserAgent
+	if agent == "" {
+		agent = "crypto-tracker/" + buildVersion()
+	}
+	httpClient.Transport = userAgentTransport{base: newTransport(cfg.HTTPProxy), agent: agent}
+	minInterval := defaultCoinGeckoMinInterval
+	if cfg.CoinGeckoMinIntervalMs > 0 {
+		minInterval = time.Duration(cfg.CoinGeckoMinIntervalMs) * time.Millisecond
+	}
+	coinGeckoLimiter.setInterval(minInterval)
+}
+
+// newTransport returns the default transport routed through proxy, or
+// through the environment's proxy settings when proxy is empty. proxy has
+// already been checked by validateConfig.
+func newTransport(proxy string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		u, _ := url.Parse(proxy)
+		t.Proxy = http.ProxyURL(u)
+	} else {
+		t.Proxy = http.ProxyFromEnvironment
+	}
+	return t
+}
+
+// userAgentTransport sets User-Agent on every request sent through base.
+type userAgentTransport struct {
+	base  http.RoundTripper
+	agent string
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the caller's request.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.agent)
+	return t.base.RoundTrip(req)
+}
+
+// drainAndClose reads whatever is left of the body so the connection can be
+// reused, then closes it. Safe to call after a partial or timed-out read.
+func drainAndClose(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// buildVersion returns the linked version, or the VCS revision recorded by
+// the Go toolchain when the binary wasn't built with one.
+func buildVersion() string {
+	if version != "dev" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 7 {
+			return version + "-" + s.Value[:7]
 		}
 	}
-	return msg
+	return version
+}
+
+func formatStartMessage(cfg Config, interval time.Duration) string {
+	return fmt.Sprintf("🟢 Crypto tracker started, tracking %d coins every %s (version %s)",
+		len(activeCoins(cfg.Coins)), formatWindow(interval), buildVersion())
+}
+
+// newLogger returns a slog logger writing text or JSON to stderr.
+func newLogger(format string) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, nil))
+}
+
+// fatal logs an error event and exits, the slog counterpart of log.Fatalf.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// === STATE ===
+
+// PriceCache holds the most recent successful fetch. The job writes it and
+// the HTTP handlers read it, so access goes through the mutex. The stored
+// maps are replaced wholesale on each Set and never mutated, so callers may
+// keep what they get. A snapshot older than the TTL is reported as stale;
+// a zero TTL never goes stale.
+type PriceCache struct {
+	mu        sync.RWMutex
+	ttl       time.Duration
+	prices    map[string]map[string]float64
+	market    map[string]map[string]marketData
+	fetchedAt time.Time
+	onSet     []func(priceSnapshot)
+}
+
+// priceSnapshot is everything a PriceCache holds, as of one fetch.
+type priceSnapshot struct {
+	Prices    map[string]map[string]float64
+	Market    map[string]map[string]marketData
+	FetchedAt time.Time
+	Stale     bool
+}
+
+func newPriceCache(ttl time.Duration) *PriceCache { return &PriceCache{ttl: ttl} }
+
+func (c *PriceCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+}
+
+// OnSet registers fn to be called with the new snapshot after every Set.
+func (c *PriceCache) OnSet(fn func(priceSnapshot)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onSet = append(c.onSet, fn)
+}
+
+func (c *PriceCache) Set(prices map[string]map[string]float64, market map[string]map[string]marketData, at time.Time) {
+	c.mu.Lock()
+	c.prices = prices
+	c.market = market
+	c.fetchedAt = at
+	snap := priceSnapshot{Prices: prices, Market: market, FetchedAt: at}
+	listeners := c.onSet
+	c.mu.Unlock()
+	for _, fn := range listeners {
+		fn(snap)
+	}
+}
+
+// Get returns coin's cached price per currency, or ok=false if it isn't
+// cached or the cache is stale.
+func (c *PriceCache) Get(coin string) (prices map[string]float64, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	prices, ok = c.prices[coin]
+	return prices, ok && !c.stale()
+}
+
+// GetAll returns the whole cache; FetchedAt is zero before the first Set.
+func (c *PriceCache) GetAll() priceSnapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return priceSnapshot{Prices: c.prices, Market: c.market, FetchedAt: c.fetchedAt, Stale: c.stale()}
+}
+
+// stale must be called with mu held.
+func (c *PriceCache) stale() bool {
+	return c.ttl > 0 && !c.fetchedAt.IsZero() && now().Sub(c.fetchedAt) > c.ttl
+}
+
+// jobHealth tracks the outcome of recent jobs for /healthz.
+type jobHealth struct {
+	breaker     *circuitBreaker
+	mu          sync.RWMutex
+	lastSuccess time.Time
+	source      string
+	lastError   string
+	lastErrorAt time.Time
+	lastRun     *fetchRun
+	saveError   string
+	saveErrorAt time.Time
+}
+
+// recordSuccess notes a fetch at at, served by source.
+func (h *jobHealth) recordSuccess(at time.Time, source string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess, h.source = at, source
+}
+
+// activeSource is the price source that served the latest fetch, "" before
+// the first.
+func (h *jobHealth) activeSource() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.source
+}
+
+func (h *jobHealth) recordError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastError = err.Error()
+	h.lastErrorAt = now()
+}
+
+// recordSave notes the outcome of the latest save; a successful one clears
+// the previous error.
+func (h *jobHealth) recordSave(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.saveError, h.saveErrorAt = "", time.Time{}
+		return
+	}
+	h.saveError = err.Error()
+	h.saveErrorAt = now()
+}
+
+// saveState is the error of the latest save, "" if it succeeded.
+func (h *jobHealth) saveState() (saveError string, at time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.saveError, h.saveErrorAt
+}
+
+func (h *jobHealth) recordRun(run fetchRun) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastRun = &run
+}
+
+func (h *jobHealth) snapshot() (lastSuccess time.Time, lastError string, lastErrorAt time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.lastSuccess, h.lastError, h.lastErrorAt
+}
+
+// latestRun returns the most recent fetch run, or nil before the first one.
+func (h *jobHealth) latestRun() *fetchRun {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.lastRun
+}
+
+// untilBoundary returns how long from now until the next multiple of
+// interval, counted from midnight UTC for intervals that divide a day.
+func untilBoundary(now time.Time, interval time.Duration) time.Duration {
+	return now.Truncate(interval).Add(interval).Sub(now)
 }
 
 // === MAIN ===
 func main() {
-	log.Println("Starting crypto tracker...")
-	cfg := loadConfig()
+	configPath := flag.String("config", defaultConfigPath, "path to the JSON config file; environment variables still override it")
+	dbPath := flag.String("db", "", "path to the SQLite database (overrides db_path in config.json)")
+	once := flag.Bool("once", false, "run a single fetch/save/notify cycle and exit; non-zero exit if it fails")
+	backfillCoin := flag.String("backfill", "", "import CoinGecko history for this coin id and exit; takes the number of days as an argument, e.g. --backfill bitcoin 30")
+	testNotifyFlag := flag.Bool("test-notify", false, "send a test message through every configured channel, report each result and exit; non-zero exit if any failed")
+	status := flag.Bool("status", false, "print the configured coins with their latest stored prices and the last successful fetch, then exit")
+	vacuum := flag.Bool("vacuum", false, "compact the SQLite database (VACUUM, then PRAGMA optimize), log its size before and after, and exit")
+	migrateOnly := flag.Bool("migrate", false, "apply any pending database schema migrations, log the schema version and exit")
+	dryRun := flag.Bool("dry-run", false, "log messages instead of sending them (overrides dry_run in config.json)")
+	coinList := flag.String("coins", "", "comma-separated coin ids to track instead of the coins in config.json, e.g. bitcoin,solana,cardano")
+	validateOnly := flag.Bool("validate-config", false, "load and validate config.json, print \"config OK\" or each problem found, and exit; non-zero exit if there are problems")
+	flag.Parse()
 
-	db, err := initDB()
+	var flagCoins []string
+	if *coinList != "" {
+		var err error
+		if flagCoins, err = parseCoinList(*coinList); err != nil {
+			fatal("Invalid --coins", "event", "config_error", "error", err)
+		}
+	}
+
+	// applyFlags lets command-line flags win over config.json, on startup
+	// and on every reload.
+	applyFlags := func(cfg *Config) {
+		if flagCoins != nil {
+			cfg.Coins = selectCoins(flagCoins, cfg.Coins)
+		}
+		if *dbPath != "" {
+			cfg.DBPath = *dbPath
+		}
+		if *dryRun {
+			cfg.DryRun = true
+		}
+	}
+
+	if *validateOnly {
+		cfg, err := readConfig(*configPath)
+		if err == nil {
+			applyFlags(&cfg)
+			err = validateConfig(cfg)
+		}
+		if err := reportConfig(os.Stdout, err); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg := loadConfig(*configPath)
+	slog.SetDefault(newLogger(cfg.LogFormat))
+	slog.Info("Starting crypto tracker...", "event", "start", "version", buildVersion())
+	applyFlags(&cfg)
+	if cfg.DryRun {
+		slog.Info("[dry-run] notifications will be logged, not sent", "event", "dry_run")
+	}
+	if err := validateConfig(cfg); err != nil {
+		fatal("invalid config", "event", "config_error", "path", *configPath, "error", err)
+	}
+	interval, _ := pollInterval(cfg)
+	applyHTTPConfig(cfg)
+	applyNumberFormat(cfg)
+	warnUntrackedHoldings(cfg)
+
+	// ctx ends on SIGINT/SIGTERM, which aborts whatever fetch, save or send
+	// is in flight.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *testNotifyFlag {
+		if err := testNotify(ctx, cfg, os.Stdout); err != nil {
+			fatal("test notification failed", "event", "notify_error", "error", err)
+		}
+		return
+	}
+
+	if *status {
+		// An offline read of the existing data: never create or migrate it.
+		db, err := openDBReadOnly(cfg)
+		if err != nil {
+			fatal("could not open the database for --status", "event", "db_error", "error", err)
+		}
+		err = printStatus(os.Stdout, cfg, db)
+		db.Close()
+		if err != nil {
+			fatal("status failed", "event", "db_error", "error", err)
+		}
+		return
+	}
+
+	db, err := openDB(cfg)
 	if err != nil {
-		log.Fatalf("DB init failed: %v", err)
+		fatal("DB init failed", "event", "db_error", "error", err)
 	}
 	defer db.Close()
 
-	var lastPrices map[string]float64
-	runJob := func() {
-		prices, err := fetchPrices()
+	if *migrateOnly {
+		v, err := schemaVersion(db)
+		db.Close()
 		if err != nil {
-			log.Printf("fetch error: %v", err)
-			return
+			fatal("could not read the schema version", "event", "db_error", "error", err)
 		}
+		slog.Info("database schema up to date", "event", "db_migrate", "version", v)
+		return
+	}
 
-		if err := savePrices(db, prices); err != nil {
-			log.Printf("save error: %v", err)
-			return
+	if *vacuum {
+		err := vacuumSQLite(ctx, cfg, db)
+		db.Close()
+		if err != nil {
+			fatal("vacuum failed", "event", "db_error", "error", err)
 		}
+		return
+	}
 
-		msg := formatMessage(prices, lastPrices)
-		lastPrices = prices
-		if err := sendTelegramMessage(cfg, msg); err != nil {
-			log.Printf("telegram error: %v", err)
+	if *backfillCoin != "" {
+		days, err := strconv.Atoi(flag.Arg(0))
+		if err != nil || days <= 0 {
+			fatal("--backfill needs a positive number of days, e.g. --backfill bitcoin 30", "event", "config_error")
+		}
+		err = backfill(ctx, cfg, db, *backfillCoin, days)
+		db.Close()
+		if err != nil {
+			fatal("backfill failed", "event", "backfill_error", "error", err)
 		}
+		return
+	}
+
+	// Coins without a configured symbol take CoinGecko's, looked up once.
+	cfg.Coins = withCoinMeta(cfg.Coins, resolveCoinMeta(ctx, cfg, db))
 
-		if err := sendSlackMessage(cfg, msg); err != nil {
-			log.Printf("slack error: %v", err)
+	// The fetch/notify job only goes through store; backfill, pruning and
+	// the HTTP API query the database directly.
+	store := sqlStore{db: db}
+
+	if cfg.NotifyOnStart {
+		if err := notify(ctx, cfg, store, message{Text: formatStartMessage(cfg, interval)}); err != nil {
+			slog.Warn("startup notification not delivered", "event", "notify_undelivered", "error", err)
 		}
-		log.Println("✅ Prices pushed successfully!")
 	}
 
-	runJob()
+	// Cached prices go stale at the same point /healthz turns unhealthy.
+	latest := newPriceCache(healthWindow(cfg))
+	health := &jobHealth{breaker: newCircuitBreaker()}
+
+	job := newJob(cfg, store, latest, health)
 
-	ticker := time.NewTicker(10 * time.Minute)
+	if *once {
+		err := job.run(ctx)
+		db.Close()
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	port := cfg.HTTPPort
+	if port == 0 {
+		port = defaultHTTPPort
+	}
+	api := newServer(cfg, db, latest, health)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: api.routes(),
+	}
+	// Shutdown doesn't wait for hijacked connections such as WebSockets.
+	srv.RegisterOnShutdown(api.hub.close)
+	go func() {
+		slog.Info("HTTP server listening", "event", "http_listen", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("http server failed", "event", "http_error", "error", err)
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	if !cfg.SkipStartupRun {
+		job.run(ctx)
+	}
+
+	// pollEvery is the ticker's period: interval, stretched after jobs that
+	// CoinGecko rate limited and eased back once it stops.
+	pollEvery := interval
+	ticker := time.NewTicker(pollEvery)
 	defer ticker.Stop()
+	// alignC fires once at the first boundary when AlignToClock is set; until
+	// then the ticker stays stopped.
+	var alignC <-chan time.Time
+	// resetTicker restarts the ticker with pollEvery moved by IntervalJitter.
+	resetTicker := func() {
+		d := jitterInterval(cfg, pollEvery)
+		ticker.Reset(d)
+		if cfg.IntervalJitter > 0 {
+			slog.Info("next run scheduled", "event", "next_run", "at", time.Now().Add(d).Format(time.RFC3339), "wait", d.Round(time.Second).String())
+		}
+	}
+	// adaptInterval reports whether it reset the ticker.
+	adaptInterval := func() bool {
+		d := coinGeckoThrottle.scale(interval)
+		if d == pollEvery {
+			return false
+		}
+		pollEvery = d
+		slog.Info("poll interval adjusted for rate limiting", "event", "poll_interval", "interval", pollEvery.String(), "configured", interval.String())
+		if alignC != nil {
+			return false
+		}
+		resetTicker()
+		return true
+	}
+	// nextTick adapts the interval after a run and, with IntervalJitter,
+	// draws a new wait until the next one. Without jitter the ticker keeps
+	// its phase.
+	nextTick := func() {
+		coinGeckoThrottle.settle()
+		if !adaptInterval() && cfg.IntervalJitter > 0 && alignC == nil {
+			resetTicker()
+		}
+	}
+
+	// With AlignToClock the ticker is held until the next multiple of the
+	// interval (UTC), so runs land on e.g. :00, :10, :20 across restarts.
+	if cfg.AlignToClock {
+		ticker.Stop()
+		wait := untilBoundary(time.Now(), interval)
+		slog.Info("waiting for the next interval boundary", "event", "align_to_clock", "wait", wait.Round(time.Second).String())
+		alignTimer := time.NewTimer(wait)
+		defer alignTimer.Stop()
+		alignC = alignTimer.C
+	}
+	nextTick()
 
-	for range ticker.C {
-		runJob()
+	// A nil channel never fires, which leaves pruning off when RetentionDays is 0.
+	var (
+		pruneTicker *time.Ticker
+		pruneC      <-chan time.Time
+	)
+	prune := func() {
+		retention := time.Duration(cfg.RetentionDays) * 24 * time.Hour
+		for _, table := range prunedTables {
+			if err := pruneOld(db, table, retention); err != nil {
+				slog.Error("prune failed", "event", "prune_error", "table", table, "error", err)
+			}
+		}
+	}
+	// updatePruning starts or stops the prune ticker to match RetentionDays,
+	// pruning straight away when it is turned on.
+	updatePruning := func() {
+		switch {
+		case cfg.RetentionDays > 0 && pruneTicker == nil:
+			prune()
+			pruneTicker = time.NewTicker(pruneInterval)
+			pruneC = pruneTicker.C
+		case cfg.RetentionDays == 0 && pruneTicker != nil:
+			pruneTicker.Stop()
+			pruneTicker, pruneC = nil, nil
+		}
+	}
+	updatePruning()
+	defer func() {
+		if pruneTicker != nil {
+			pruneTicker.Stop()
+		}
+	}()
+
+	// The digest runs on its own timer, rescheduled after every send and
+	// reload; a nil channel again leaves it off.
+	var (
+		digestTimer *time.Timer
+		digestC     <-chan time.Time
+	)
+	scheduleDigest := func() {
+		if digestTimer != nil {
+			digestTimer.Stop()
+			digestTimer, digestC = nil, nil
+		}
+		if !cfg.DigestEnabled {
+			return
+		}
+		wait := untilDigest(cfg, time.Now())
+		digestTimer = time.NewTimer(wait)
+		digestC = digestTimer.C
+		slog.Info("daily digest scheduled", "event", "digest_scheduled", "wait", wait.Round(time.Second).String())
+	}
+	sendDigest := func() {
+		text, err := buildDigest(cfg, db, now())
+		switch {
+		case err != nil:
+			slog.Error("digest failed", "event", "digest_error", "error", err)
+		case text == "":
+			slog.Info("no prices stored in the last day, digest skipped", "event", "digest_skipped")
+		default:
+			if err := notify(ctx, cfg, store, message{Text: text}); err != nil && ctx.Err() == nil {
+				slog.Error("digest not delivered on any channel", "event", "notify_undelivered", "error", err)
+			}
+		}
+	}
+	scheduleDigest()
+	defer func() {
+		if digestTimer != nil {
+			digestTimer.Stop()
+		}
+	}()
+
+	// reload re-reads the config file on SIGHUP and applies it to the running
+	// loop. An invalid config is logged and the current one kept; in-memory
+	// state such as lastPrices carries over.
+	reload := func() {
+		next, err := readConfig(*configPath)
+		if err != nil {
+			slog.Error("config reload failed, keeping the current config", "event", "config_reload_error", "error", err)
+			return
+		}
+		applyFlags(&next)
+		next.Coins = withCoinMeta(next.Coins, resolveCoinMeta(ctx, next, db))
+		if err := validateConfig(next); err != nil {
+			slog.Error("config reload rejected, keeping the current config", "event", "config_reload_error", "error", err)
+			return
+		}
+		if next.DBDriver != cfg.DBDriver || next.DBPath != cfg.DBPath || next.DBDSN != cfg.DBDSN || next.HTTPPort != cfg.HTTPPort {
+			slog.Warn("db_driver, db_path, db_dsn and http_port only change on restart", "event", "config_reload_ignored")
+			next.DBDriver, next.DBPath, next.DBDSN, next.HTTPPort = cfg.DBDriver, cfg.DBPath, cfg.DBDSN, cfg.HTTPPort
+		}
+		changed := configChanges(cfg, next)
+		if len(changed) == 0 {
+			slog.Info("config reloaded, nothing changed", "event", "config_reload")
+			return
+		}
+		cfg = next
+		slog.SetDefault(newLogger(cfg.LogFormat))
+		applyHTTPConfig(cfg)
+		applyNumberFormat(cfg)
+		warnUntrackedHoldings(cfg)
+		job.setConfig(cfg)
+		api.setConfig(cfg)
+		latest.SetTTL(healthWindow(cfg))
+		if d, _ := pollInterval(cfg); d != interval {
+			interval = d
+			adaptInterval()
+		}
+		updatePruning()
+		scheduleDigest()
+		slog.Info("config reloaded", "event", "config_reload", "changed", strings.Join(changed, ","))
+	}
+
+	// Jobs run on this goroutine. A shutdown signal mid-job cancels ctx, so
+	// the job gives up promptly and the loop then sees ctx.Done.
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("shutting down", "event", "shutdown")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Error("http shutdown failed", "event", "http_error", "error", err)
+			}
+			cancel()
+			return
+		case <-hup:
+			reload()
+		case <-alignC:
+			alignC = nil
+			ticker.Reset(pollEvery)
+			// The first boundary run is deliberate, however soon it comes
+			// after the startup run.
+			job.lastRunAt = time.Time{}
+			job.run(ctx)
+			nextTick()
+		case <-ticker.C:
+			job.run(ctx)
+			nextTick()
+		case <-pruneC:
+			prune()
+		case <-digestC:
+			sendDigest()
+			scheduleDigest()
+		}
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSavePricesOverParamLimit(t *testing.T) {
+	db := openTestDB(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := testRecords([]string{"bitcoin", "ethereum"}, 100, start)
+	if len(records)*priceRowParams <= maxSQLParams {
+		t.Fatalf("%d records fit in one INSERT; the test needs more", len(records))
+	}
+	ctx := context.Background()
+	if err := savePrices(ctx, db, records); err != nil {
+		t.Fatal(err)
+	}
+	// Saving again takes the same row-by-row path and must upsert, not
+	// duplicate.
+	for i := range records {
+		records[i].Price *= 2
+	}
+	if err := savePrices(ctx, db, records); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	var total float64
+	if err := db.QueryRow("SELECT COUNT(*), SUM(price_usd) FROM prices").Scan(&count, &total); err != nil {
+		t.Fatal(err)
+	}
+	var want float64
+	for _, r := range records {
+		want += r.Price
+	}
+	if count != len(records) || total != want {
+		t.Errorf("stored %d rows totalling %v, want %d totalling %v", count, total, len(records), want)
+	}
+}
+
+func benchmarkInsertPrices(b *testing.B, insert func(context.Context, *Tx, []PriceRecord) error) {
+	db := openTestDB(b)
+	// The largest batch that still fits in one INSERT.
+	records := testRecords([]string{"bitcoin"}, maxSQLParams/priceRowParams, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+	b.ReportAllocs()
+	for b.Loop() {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := insert(ctx, tx, records); err != nil {
+			b.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInsertPricesBatch(b *testing.B) { benchmarkInsertPrices(b, insertPricesBatch) }
+
+func BenchmarkInsertPricesEach(b *testing.B) { benchmarkInsertPrices(b, insertPricesEach) }
+
+func TestNewTransportProxy(t *testing.T) {
+	var seen []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy gets the absolute URL of the real target.
+		seen = append(seen, r.URL.String())
+		w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	client := &http.Client{Transport: newTransport(proxy.URL)}
+	resp, err := client.Get("http://prices.example/simple/price?ids=bitcoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "via proxy" {
+		t.Errorf("body = %q, want the proxy's reply", body)
+	}
+	if want := "http://prices.example/simple/price?ids=bitcoin"; len(seen) != 1 || seen[0] != want {
+		t.Errorf("proxy saw %q, want [%q]", seen, want)
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// === HELPER ===
+// messageData is what a MessageTemplate is executed against.
+type messageData struct {
+	Time       string
+	Currencies []string
+	Coins      []coinLine
+	// Portfolio is nil unless holdings are configured and could be valued.
+	Portfolio *portfolioValue
+}
+
+// coinLine is one coin's prices in a message. Changes and Trends only have
+// entries for currencies with a previous price to compare against, Ranges
+// and Sparklines only for currencies with enough stored history, Market only
+// when market fields are enabled.
+type coinLine struct {
+	ID         string
+	Symbol     string
+	Emoji      string
+	Prices     map[string]float64
+	Changes    map[string]float64
+	Trends     map[string]string
+	Ranges     map[string]priceRange
+	Sparklines map[string]string
+	Market     map[string]marketData
+	// Decimals is the precision each price, and its change and range, is
+	// shown with.
+	Decimals map[string]int
+}
+
+// changePercent returns the coin's change in cur as a percentage of the
+// previous price, or ok=false when there is nothing to compare against.
+func (c coinLine) changePercent(cur string) (pct float64, ok bool) {
+	change, ok := c.Changes[cur]
+	if !ok {
+		return 0, false
+	}
+	return change / (c.Prices[cur] - change) * 100, true
+}
+
+// priceRange is the 24h high and low of a coin in one currency.
+type priceRange struct {
+	High float64
+	Low  float64
+}
+
+// templateFuncs are available in MessageTemplate alongside the builtins.
+var templateFuncs = template.FuncMap{
+	"amount":  formatAmount,
+	"fixed":   formatFixed,
+	"compact": formatCompact,
+	"change":  formatChange,
+	"percent": formatPercent,
+	"trend":   trendArrow,
+	"upper":   strings.ToUpper,
+}
+
+// parseMessageTemplate compiles a MessageTemplate. An empty text yields a
+// nil template, meaning the built-in format.
+func parseMessageTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("message").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// messageTime is how the fetch time is shown in messages, zone included so
+// it can't be mistaken for the reader's local time.
+const messageTime = "2006-01-02 15:04:05 MST"
+
+func buildMessageData(coins []CoinSpec, currencies []string, prices, lastPrices map[string]map[string]float64, ranges map[string]map[string]priceRange, recent map[string]map[string][]float64, market map[string]map[string]marketData, at time.Time) messageData {
+	data := messageData{
+		Time:       at.Format(messageTime),
+		Currencies: currencies,
+	}
+	for _, c := range coins {
+		line := coinLine{
+			ID:         c.ID,
+			Symbol:     coinSymbol(c),
+			Emoji:      c.Emoji,
+			Prices:     map[string]float64{},
+			Changes:    map[string]float64{},
+			Trends:     map[string]string{},
+			Ranges:     map[string]priceRange{},
+			Sparklines: map[string]string{},
+			Market:     map[string]marketData{},
+			Decimals:   map[string]int{},
+		}
+		for _, cur := range currencies {
+			price, ok := prices[c.ID][cur]
+			if !ok {
+				continue
+			}
+			line.Prices[cur] = price
+			line.Decimals[cur] = c.decimals(price)
+			if last := lastPrices[c.ID][cur]; last > 0 {
+				line.Changes[cur] = price - last
+				line.Trends[cur] = trendArrow(price - last)
+			}
+			if r, ok := ranges[c.ID][cur]; ok {
+				line.Ranges[cur] = r
+			}
+			if spark := sparkline(recent[c.ID][cur]); spark != "" {
+				line.Sparklines[cur] = spark
+			}
+			if m, ok := market[c.ID][cur]; ok {
+				line.Market[cur] = m
+			}
+		}
+		data.Coins = append(data.Coins, line)
+	}
+	return data
+}
+
+// updateData builds the regular update's messageData for prices fetched at
+// fetchedAt, with the time shown in cfg.Timezone. recent holds the stored
+// prices sparklines are drawn from, market any market fields fetched.
+func updateData(cfg Config, prices, lastPrices map[string]map[string]float64, ranges map[string]map[string]priceRange, recent map[string]map[string][]float64, market map[string]map[string]marketData, fetchedAt time.Time) messageData {
+	data := buildMessageData(cfg.Coins, cfg.Currencies, prices, lastPrices, ranges, recent, market, fetchedAt.In(displayLocation(cfg)))
+	for i, c := range data.Coins {
+		for cur, price := range c.Prices {
+			c.Decimals[cur] = priceDecimals(cfg, cfg.Coins[i], cur, price)
+		}
+	}
+	sortCoinLines(data.Coins, cfg.Order, cfg.Currencies[0])
+	return data
+}
+
+// sortCoinLines puts lines in the given Order, stably so ties keep config
+// order. For price_desc, lines without a price in currency go last.
+func sortCoinLines(lines []coinLine, order, currency string) {
+	switch order {
+	case "alpha":
+		slices.SortStableFunc(lines, func(a, b coinLine) int {
+			return strings.Compare(strings.ToLower(a.Symbol), strings.ToLower(b.Symbol))
+		})
+	case "price_desc":
+		slices.SortStableFunc(lines, func(a, b coinLine) int {
+			pa, oka := a.Prices[currency]
+			pb, okb := b.Prices[currency]
+			switch {
+			case oka != okb:
+				if oka {
+					return -1
+				}
+				return 1
+			case pa > pb:
+				return -1
+			case pa < pb:
+				return 1
+			}
+			return 0
+		})
+	}
+}
+
+// formatMessage renders the regular price update, using the MessageTemplate
+// readConfig compiled when one is set and the built-in format otherwise or
+// if it fails.
+func formatMessage(cfg Config, data messageData) string {
+	if cfg.messageTmpl != nil {
+		var b strings.Builder
+		err := cfg.messageTmpl.Execute(&b, data)
+		if err == nil {
+			return b.String()
+		}
+		slog.Warn("message template failed, using default format", "event", "template_error", "error", err)
+	}
+	return formatDefaultMessage(data)
+}
+
+func formatDefaultMessage(data messageData) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "📊 *Crypto Prices (%s)*\nTime: %s\n", strings.ToUpper(strings.Join(data.Currencies, ", ")), data.Time)
+	for _, c := range data.Coins {
+		for _, cur := range data.Currencies {
+			price, ok := c.Prices[cur]
+			if !ok {
+				continue
+			}
+			b.WriteString("\n")
+			if t, ok := c.Trends[cur]; ok {
+				b.WriteString(t + " ")
+			}
+			if c.Emoji != "" {
+				b.WriteString(c.Emoji + " ")
+			}
+			d := c.Decimals[cur]
+			fmt.Fprintf(&b, "%s: %s", c.Symbol, formatFixed(cur, price, d))
+			if change, ok := c.Changes[cur]; ok {
+				fmt.Fprintf(&b, " Change: %s", formatChangeFixed(cur, change, d))
+			}
+			if r, ok := c.Ranges[cur]; ok {
+				fmt.Fprintf(&b, " | 24h H: %s L: %s", formatFixed(cur, r.High, d), formatFixed(cur, r.Low, d))
+			}
+			if m := c.Market[cur]; m.MarketCap != nil {
+				fmt.Fprintf(&b, " | MCap: %s", formatCompact(cur, *m.MarketCap))
+			}
+			if m := c.Market[cur]; m.Volume24h != nil {
+				fmt.Fprintf(&b, " | Vol: %s", formatCompact(cur, *m.Volume24h))
+			}
+			if m := c.Market[cur]; m.Change24h != nil {
+				b.WriteString(" | 24h: " + formatPercent(*m.Change24h, 1))
+			}
+			if spark, ok := c.Sparklines[cur]; ok {
+				b.WriteString(" " + spark)
+			}
+		}
+	}
+	if p := data.Portfolio; p != nil {
+		fmt.Fprintf(&b, "\n\n💼 Portfolio: %s", formatAmount(p.Currency, p.Value))
+		if p.Change != nil {
+			fmt.Fprintf(&b, " (Δ %s)", formatChange(p.Currency, *p.Change))
+		}
+	}
+	return b.String()
+}
+
+// percentMove is a coin whose price moved more than its alert threshold
+// between two fetches. Suppressed counts the coin's alerts held back by the
+// cooldown since it last fired.
+type percentMove struct {
+	Coin       CoinSpec
+	Last       float64
+	Price      float64
+	Pct        float64
+	Threshold  float64
+	Suppressed int
+}
+
+// percentMoves returns the coins whose price moved more than their
+// threshold percent since lastPrices, in the given currency. Coins without
+// a threshold or a previous price are skipped.
+func percentMoves(coins []CoinSpec, currency string, thresholds map[string]float64, prices, lastPrices map[string]map[string]float64) []percentMove {
+	var moves []percentMove
+	for _, c := range coins {
+		threshold := thresholds[c.ID]
+		last := lastPrices[c.ID][currency]
+		price, ok := prices[c.ID][currency]
+		if threshold <= 0 || last <= 0 || !ok {
+			continue
+		}
+		pct := (price - last) / last * 100
+		if math.Abs(pct) <= threshold {
+			continue
+		}
+		moves = append(moves, percentMove{Coin: c, Last: last, Price: price, Pct: pct, Threshold: threshold})
+	}
+	return moves
+}
+
+// formatAlert builds the alert text for moves in the given currency, or ""
+// when there are none. Moves past different thresholds each name theirs.
+func formatAlert(currency string, moves []percentMove) string {
+	if len(moves) == 0 {
+		return ""
+	}
+	same := true
+	for _, m := range moves {
+		same = same && m.Threshold == moves[0].Threshold
+	}
+	var lines []string
+	for _, m := range moves {
+		d := m.Coin.decimals(m.Price)
+		line := fmt.Sprintf("%s: %s → %s (%s)",
+			coinSymbol(m.Coin), formatFixed(currency, m.Last, d), formatFixed(currency, m.Price, d), formatPercent(m.Pct, 2))
+		if !same {
+			line += " past " + formatNumber(m.Threshold, 2) + "%"
+		}
+		if m.Suppressed > 0 {
+			line += fmt.Sprintf(" — %d more suppressed during cooldown", m.Suppressed)
+		}
+		lines = append(lines, line)
+	}
+	if !same {
+		return "🚨 ALERT: prices moved past their alert thresholds\n\n" + strings.Join(lines, "\n")
+	}
+	return fmt.Sprintf("🚨 ALERT: price moved more than %s%%\n\n%s", formatNumber(moves[0].Threshold, 2), strings.Join(lines, "\n"))
+}
+
+// trendArrow is ▲, ▼ or ▬ for a positive, negative or zero change.
+func trendArrow(change float64) string {
+	switch {
+	case change > 0:
+		return "▲"
+	case change < 0:
+		return "▼"
+	}
+	return "▬"
+}
+
+// sparkBlocks are the sparkline levels, lowest first.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// minSparklinePoints is the least history worth drawing a sparkline for.
+const minSparklinePoints = 3
+
+// sparkline draws values as block characters scaled between their min and
+// max, or returns "" when there are too few to show a trend.
+func sparkline(values []float64) string {
+	if len(values) < minSparklinePoints {
+		return ""
+	}
+	lo, hi := slices.Min(values), slices.Max(values)
+	out := make([]rune, len(values))
+	for i, v := range values {
+		level := 0
+		if hi > lo {
+			level = int((v - lo) / (hi - lo) * float64(len(sparkBlocks)-1))
+		}
+		out[i] = sparkBlocks[level]
+	}
+	return string(out)
+}
+
+// coinSymbol returns the display label for a coin, falling back to its id.
+// loadConfig fills in blank symbols once, so the fallback only matters for
+// coins that aren't in the config.
+func coinSymbol(c CoinSpec) string {
+	if c.Symbol != "" {
+		return c.Symbol
+	}
+	return strings.ToUpper(c.ID)
+}
+
+// maxDecimals bounds CoinSpec.Decimals and autoDecimals.
+const maxDecimals = 12
+
+// autoSignificantDigits is how many digits autoDecimals keeps for amounts
+// under a cent.
+const autoSignificantDigits = 4
+
+// autoDecimals is the precision for v when none is configured: two
+// decimals, or enough for autoSignificantDigits on amounts under a cent so
+// e.g. 0.00002134 doesn't print as 0.00.
+func autoDecimals(v float64) int {
+	a := math.Abs(v)
+	if a == 0 || a >= 0.01 {
+		return 2
+	}
+	return min(autoSignificantDigits-1-int(math.Floor(math.Log10(a))), maxDecimals)
+}
+
+// formatAmount renders a price with autoDecimals; USD keeps the "$" prefix,
+// others get the code.
+func formatAmount(currency string, v float64) string {
+	return formatFixed(currency, v, autoDecimals(v))
+}
+
+// formatFixed is formatAmount with the given number of decimals.
+func formatFixed(currency string, v float64, decimals int) string {
+	if currency == "usd" {
+		n := formatNumber(v, decimals)
+		if abs, ok := strings.CutPrefix(n, "-"); ok {
+			return "-$" + abs
+		}
+		return "$" + n
+	}
+	return formatNumber(v, decimals) + " " + strings.ToUpper(currency)
+}
+
+// formatCompact renders a large amount such as a market cap with a K/M/B/T
+// suffix, e.g. "$1.23T".
+func formatCompact(currency string, v float64) string {
+	suffix := ""
+	for _, u := range []struct {
+		div    float64
+		suffix string
+	}{{1e12, "T"}, {1e9, "B"}, {1e6, "M"}, {1e3, "K"}} {
+		if math.Abs(v) >= u.div {
+			v, suffix = v/u.div, u.suffix
+			break
+		}
+	}
+	if currency == "usd" {
+		return "$" + formatNumber(v, 2) + suffix
+	}
+	return formatNumber(v, 2) + suffix + " " + strings.ToUpper(currency)
+}
+
+func formatChange(currency string, v float64) string {
+	return formatChangeFixed(currency, v, 2)
+}
+
+// formatChangeFixed is formatChange with the given number of decimals,
+// normally those of the price that changed.
+func formatChangeFixed(currency string, v float64, decimals int) string {
+	if currency == "usd" {
+		return formatNumber(v, decimals) + "$"
+	}
+	return formatNumber(v, decimals) + " " + strings.ToUpper(currency)
+}
+
+// formatPercent renders a percentage with an explicit sign, e.g. "+1.25%".
+func formatPercent(v float64, decimals int) string {
+	n := formatNumber(v, decimals)
+	if !strings.HasPrefix(n, "-") {
+		n = "+" + n
+	}
+	return n + "%"
+}
+
+// === NUMBER FORMAT ===
+
+// numberStyle is how amounts are written: the decimal separator, and the
+// separator put between groups of three integer digits ("" for none).
+type numberStyle struct {
+	Decimal string
+	Group   string
+}
+
+// numberLocales are the accepted values of Config.NumberLocale.
+var numberLocales = map[string]numberStyle{
+	"en":    {Decimal: ".", Group: ","},
+	"de":    {Decimal: ",", Group: "."},
+	"fr":    {Decimal: ",", Group: "\u202f"}, // narrow no-break space
+	"ch":    {Decimal: ".", Group: "'"},
+	"plain": {Decimal: "."},
+}
+
+const defaultNumberLocale = "en"
+
+// numberFormat is the style every amount is rendered in. It is set from the
+// config at startup and on reload while handlers may be formatting.
+var numberFormat atomic.Pointer[numberStyle]
+
+func init() {
+	s := numberLocales[defaultNumberLocale]
+	numberFormat.Store(&s)
+}
+
+// configNumberStyle is cfg's locale with its explicit separators applied on
+// top.
+func configNumberStyle(cfg Config) numberStyle {
+	locale := cfg.NumberLocale
+	if locale == "" {
+		locale = defaultNumberLocale
+	}
+	s := numberLocales[locale]
+	if cfg.DecimalSeparator != "" {
+		s.Decimal = cfg.DecimalSeparator
+	}
+	if cfg.GroupSeparator != "" {
+		s.Group = cfg.GroupSeparator
+	}
+	return s
+}
+
+func applyNumberFormat(cfg Config) {
+	s := configNumberStyle(cfg)
+	numberFormat.Store(&s)
+}
+
+func validateNumberFormat(cfg Config) error {
+	if cfg.NumberLocale != "" {
+		if _, ok := numberLocales[cfg.NumberLocale]; !ok {
+			return fmt.Errorf("number_locale must be one of %s, got %q", strings.Join(slices.Sorted(maps.Keys(numberLocales)), ", "), cfg.NumberLocale)
+		}
+	}
+	for _, sep := range []struct{ name, v string }{{"decimal_separator", cfg.DecimalSeparator}, {"group_separator", cfg.GroupSeparator}} {
+		if strings.ContainsAny(sep.v, "0123456789+-") {
+			return fmt.Errorf("%s must not contain digits or signs, got %q", sep.name, sep.v)
+		}
+	}
+	if s := configNumberStyle(cfg); s.Decimal == s.Group {
+		return fmt.Errorf("decimal and group separators must differ, both are %q", s.Decimal)
+	}
+	return nil
+}
+
+// formatNumber renders v with decimals in numberFormat's style, e.g.
+// "107,432.50". Grouping only touches the integer part, so an amount below
+// 1000 such as 0.00001234 is unchanged but for the decimal separator. A
+// value that rounds to zero drops its minus sign.
+func formatNumber(v float64, decimals int) string {
+	style := numberFormat.Load()
+	s := strconv.FormatFloat(math.Abs(v), 'f', decimals, 64)
+	intPart, frac, _ := strings.Cut(s, ".")
+	var b strings.Builder
+	if v < 0 && strings.ContainsFunc(s, func(r rune) bool { return r >= '1' && r <= '9' }) {
+		b.WriteByte('-')
+	}
+	for i, d := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(style.Group)
+		}
+		b.WriteRune(d)
+	}
+	if frac != "" {
+		b.WriteString(style.Decimal + frac)
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoDecimals(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want int
+	}{
+		{0, 2},
+		{107432.5, 2},
+		{0.01, 2},
+		{-0.5, 2},
+		{0.009, 6},
+		{0.00002134, 8},
+		{-0.00002134, 8},
+		{1e-20, maxDecimals},
+	}
+	for _, tt := range tests {
+		if got := autoDecimals(tt.v); got != tt.want {
+			t.Errorf("autoDecimals(%v) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestFormatFixed(t *testing.T) {
+	two, zero, five := 2, 0, 5
+	tests := []struct {
+		name     string
+		currency string
+		v        float64
+		decimals *int
+		want     string
+	}{
+		{"large usd", "usd", 100000, nil, "$100,000.00"},
+		{"tiny usd", "usd", 0.00002, nil, "$0.00002000"},
+		{"negative usd", "usd", -1234.5, nil, "-$1,234.50"},
+		{"eur code", "eur", 3200.1, nil, "3,200.10 EUR"},
+		{"explicit two on a tiny price", "usd", 0.00002, &two, "$0.00"},
+		{"explicit zero", "usd", 100000.4, &zero, "$100,000"},
+		{"explicit five", "eur", 1.5, &five, "1.50000 EUR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := CoinSpec{ID: "x", Decimals: tt.decimals}
+			if got := formatFixed(tt.currency, tt.v, c.decimals(tt.v)); got != tt.want {
+				t.Errorf("formatFixed(%q, %v) = %q, want %q", tt.currency, tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkFormatMessage(b *testing.B) {
+	var coins []CoinSpec
+	prices := map[string]map[string]float64{}
+	last := map[string]map[string]float64{}
+	for i := range 20 {
+		id := fmt.Sprintf("coin%d", i)
+		coins = append(coins, CoinSpec{ID: id, Symbol: fmt.Sprintf("C%d", i)})
+		prices[id] = map[string]float64{"usd": 1000 + float64(i), "eur": 900 + float64(i)}
+		last[id] = map[string]float64{"usd": 990, "eur": 890}
+	}
+	data := buildMessageData(coins, []string{"usd", "eur"}, prices, last, nil, nil, nil, time.Date(2026, 1, 2, 8, 0, 0, 0, time.UTC))
+	cfg := Config{}
+	b.ReportAllocs()
+	for b.Loop() {
+		formatMessage(cfg, data)
+	}
+}
+
+func TestUpdateMessageTime(t *testing.T) {
+	fixClock(t, time.Date(2026, 1, 2, 8, 0, 0, 0, time.UTC))
+	cfg := Config{
+		Coins:      []CoinSpec{{ID: "bitcoin", Symbol: "BTC"}},
+		Currencies: []string{"usd"},
+		Timezone:   "Asia/Ho_Chi_Minh",
+	}
+	prices := map[string]map[string]float64{"bitcoin": {"usd": 107432.5}}
+	got := formatMessage(cfg, updateData(cfg, prices, nil, nil, nil, nil, now()))
+	want := "📊 *Crypto Prices (USD)*\nTime: 2026-01-02 15:00:00 +07\n\nBTC: $107,432.50"
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("message =\n%s\nwant it to start\n%s", got, want)
+	}
+}
+
+func TestFormatMessageTemplate(t *testing.T) {
+	data := messageData{Time: "2026-01-02 08:00:00 UTC", Currencies: []string{"usd"}, Coins: []coinLine{{Symbol: "BTC", Prices: map[string]float64{"usd": 100}}}}
+
+	cfg, err := readConfigFile(t, `{"message_template": "{{range .Coins}}{{.Symbol}}={{amount \"usd\" (index .Prices \"usd\")}}{{end}}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatMessage(cfg, data); got != "BTC=$100.00" {
+		t.Errorf("templated message = %q, want BTC=$100.00", got)
+	}
+
+	// A template that doesn't parse is a config problem, reported once at
+	// load; formatting falls back quietly instead of warning every run.
+	bad, err := readConfigFile(t, `{"message_template": "{{.Coins"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasProblem(validateConfig(bad), "message_template") {
+		t.Error("validateConfig accepted an unparsable template")
+	}
+	logged := captureLog(t)
+	for range 3 {
+		if got := formatMessage(bad, data); got != formatDefaultMessage(data) {
+			t.Errorf("message = %q, want the default format", got)
+		}
+	}
+	if warns := logged("template_error"); len(warns) != 0 {
+		t.Errorf("logged %d template errors while formatting", len(warns))
+	}
+	if changed := configChanges(cfg, bad); !reflect.DeepEqual(changed, []string{"message_template"}) {
+		t.Errorf("configChanges = %v, want [message_template]", changed)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, registered on the default registry and served at /metrics.
+var (
+	fetchTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "crypto_fetch_total",
+		Help: "Price fetch attempts, counting each run once regardless of retries.",
+	})
+	fetchErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "crypto_fetch_errors_total",
+		Help: "Price fetches that failed after all retries.",
+	})
+	notifyErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "crypto_notify_errors_total",
+		Help: "Failed notification sends by channel.",
+	}, []string{"channel"})
+	priceUSD = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "crypto_price_usd",
+		Help: "Latest fetched USD price by coin id.",
+	}, []string{"coin"})
+)
+
+// recordPriceMetrics updates the price gauges from a successful fetch.
+func recordPriceMetrics(prices map[string]map[string]float64) {
+	for coin, byCur := range prices {
+		if v, ok := byCur["usd"]; ok {
+			priceUSD.WithLabelValues(coin).Set(v)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// === MIGRATIONS ===
+
+// migration is one step of the schema. Steps run in version order, each
+// once per database, and are recorded in schema_migrations. A database
+// created before schema_migrations existed runs them all, so every step is
+// written to leave tables that already have its change alone.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, tx *Tx) error
+}
+
+// migrations is append-only: never edit or reorder a released step, add a
+// new one instead.
+var migrations = []migration{
+	{1, "create tables", createTables},
+	{2, "add prices.currency", func(ctx context.Context, tx *Tx) error {
+		// price_usd holds the price in `currency`; the column name predates
+		// multi-currency support and is kept so existing databases still work.
+		return ensureColumn(ctx, tx, "prices", "currency", "TEXT NOT NULL DEFAULT 'usd'")
+	}},
+	{3, "add prices market columns", func(ctx context.Context, tx *Tx) error {
+		// Market fields are only filled when enabled in the config.
+		for _, col := range []string{"market_cap", "volume_24h", "change_24h"} {
+			if err := ensureColumn(ctx, tx, "prices", col, "REAL"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{4, "one price per coin, currency and time", uniquePrices},
+	{5, "create coins_meta", func(ctx context.Context, tx *Tx) error {
+		_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS coins_meta (
+			id TEXT PRIMARY KEY,
+			symbol TEXT NOT NULL,
+			name TEXT NOT NULL,
+			fetched_at TIMESTAMP NOT NULL
+		)`)
+		return err
+	}},
+	{6, "add prices.source", func(ctx context.Context, tx *Tx) error {
+		// The price source that served the row; NULL for rows stored before.
+		return ensureColumn(ctx, tx, "prices", "source", "TEXT")
+	}},
+}
+
+// migrationLockID is the Postgres advisory lock that keeps replicas
+// starting together from migrating at the same time.
+const migrationLockID = 7463_2201
+
+// migrate applies the migrations db hasn't had yet, in one transaction.
+func migrate(ctx context.Context, db *DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if db.postgres {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(?)", migrationLockID); err != nil {
+			return err
+		}
+	}
+	applied, err := appliedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if err := m.up(ctx, tx); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			m.version, m.name, now().UTC().Format(sqliteTime)); err != nil {
+			return err
+		}
+		slog.Info("migration applied", "event", "db_migrate", "version", m.version, "name", m.name)
+	}
+	return tx.Commit()
+}
+
+func appliedMigrations(ctx context.Context, tx *Tx) (map[int]bool, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[int]bool{}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out[v] = true
+	}
+	return out, rows.Err()
+}
+
+// schemaVersion is the newest migration applied to db, 0 for none.
+func schemaVersion(db *DB) (int, error) {
+	var v sql.NullInt64
+	err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&v)
+	return int(v.Int64), err
+}
+
+// checkSchema fails unless db has every migration applied, without
+// applying any.
+func checkSchema(db *DB) error {
+	v, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("not a tracker database (no schema_migrations): %w", err)
+	}
+	if want := migrations[len(migrations)-1].version; v < want {
+		return fmt.Errorf("database schema is at version %d, want %d; run --migrate first", v, want)
+	}
+	return nil
+}
+
+// createTables is the schema as it stood before migrations: CREATE TABLE IF
+// NOT EXISTS for every table. The Postgres tables started out with the
+// columns later SQLite steps add.
+func createTables(ctx context.Context, tx *Tx) error {
+	stmts := sqliteTables
+	if tx.db.postgres {
+		stmts = postgresTables
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var sqliteTables = []string{`
+	CREATE TABLE IF NOT EXISTS prices (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		coin TEXT NOT NULL,
+		price_usd REAL NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_prices_coin_time ON prices(coin, created_at)`, `
+	CREATE TABLE IF NOT EXISTS fetch_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started_at DATETIME NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		ok INTEGER NOT NULL,
+		error TEXT
+	)`, `
+	CREATE TABLE IF NOT EXISTS failed_notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		channel TEXT NOT NULL,
+		text TEXT NOT NULL,
+		error TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		channel TEXT NOT NULL,
+		text TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		duration_ms INTEGER NOT NULL,
+		created_at DATETIME NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS portfolio_value (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		currency TEXT NOT NULL,
+		value REAL NOT NULL,
+		created_at DATETIME NOT NULL
+	)`,
+}
+
+var postgresTables = []string{`
+	CREATE TABLE IF NOT EXISTS prices (
+		id BIGSERIAL PRIMARY KEY,
+		coin TEXT NOT NULL,
+		currency TEXT NOT NULL DEFAULT 'usd',
+		price_usd DOUBLE PRECISION NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+		market_cap DOUBLE PRECISION,
+		volume_24h DOUBLE PRECISION,
+		change_24h DOUBLE PRECISION
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_prices_coin_time ON prices(coin, created_at)`, `
+	CREATE TABLE IF NOT EXISTS fetch_runs (
+		id BIGSERIAL PRIMARY KEY,
+		started_at TIMESTAMP NOT NULL,
+		duration_ms BIGINT NOT NULL,
+		ok BOOLEAN NOT NULL,
+		error TEXT
+	)`, `
+	CREATE TABLE IF NOT EXISTS failed_notifications (
+		id BIGSERIAL PRIMARY KEY,
+		channel TEXT NOT NULL,
+		text TEXT NOT NULL,
+		error TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id BIGSERIAL PRIMARY KEY,
+		channel TEXT NOT NULL,
+		text TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		duration_ms BIGINT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`, `
+	CREATE TABLE IF NOT EXISTS portfolio_value (
+		id BIGSERIAL PRIMARY KEY,
+		currency TEXT NOT NULL,
+		value DOUBLE PRECISION NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+}
+
+// ensureColumn adds a column to an existing table if it's not there yet.
+func ensureColumn(ctx context.Context, tx *Tx, table, column, decl string) error {
+	if tx.db.postgres {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column, decl))
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			typ     string
+			notNull int
+			dflt    sql.NullString
+			pk      int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
+// uniquePrices adds the unique index savePrices' ON CONFLICT relies on.
+// Older databases may hold exact duplicates the index can't be built over;
+// those are deleted first, keeping the earliest row of each.
+func uniquePrices(ctx context.Context, tx *Tx) error {
+	res, err := tx.ExecContext(ctx, `DELETE FROM prices WHERE id NOT IN (SELECT MIN(id) FROM prices GROUP BY coin, currency, created_at)`)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Warn("removed duplicate price rows", "event", "db_dedupe", "rows", n)
+	}
+	_, err = tx.ExecContext(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS idx_prices_unique ON prices(coin, currency, created_at)`)
+	return err
+}
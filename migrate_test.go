@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDB opens a fresh, migrated SQLite database in the test's temp dir.
+func openTestDB(t testing.TB) *DB {
+	t.Helper()
+	db, err := initDB(filepath.Join(t.TempDir(), "prices.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testRecords returns n prices per coin, a minute apart from start.
+func testRecords(coins []string, n int, start time.Time) []PriceRecord {
+	var out []PriceRecord
+	for _, coin := range coins {
+		for i := range n {
+			out = append(out, PriceRecord{Coin: coin, Currency: "usd", Price: float64(100 + i), FetchedAt: start.Add(time.Duration(i) * time.Minute)})
+		}
+	}
+	return out
+}
+
+func TestPricesCoinTimeIndex(t *testing.T) {
+	db := openTestDB(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := savePrices(context.Background(), db, testRecords([]string{"bitcoin", "ethereum", "solana"}, 1000, start)); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query("SELECT name FROM pragma_index_list('prices')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		indexes = append(indexes, name)
+	}
+	rows.Close()
+	if !strings.Contains(strings.Join(indexes, ","), "idx_prices_coin_time") {
+		t.Fatalf("indexes on prices = %v, want idx_prices_coin_time", indexes)
+	}
+
+	// The /history range query must not scan the whole table.
+	plan, err := db.Query(`EXPLAIN QUERY PLAN SELECT price_usd FROM prices WHERE coin = ? AND created_at >= ? AND created_at <= ?`,
+		"bitcoin", start.Format(sqliteTime), start.Add(time.Hour).Format(sqliteTime))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plan.Close()
+	var steps []string
+	for plan.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := plan.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatal(err)
+		}
+		steps = append(steps, detail)
+	}
+	if got := strings.Join(steps, "; "); !strings.Contains(got, "USING INDEX idx_prices_coin_time") {
+		t.Errorf("query plan %q doesn't use idx_prices_coin_time", got)
+	}
+}
+
+func TestInitDBAwkwardPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "my data")
+	path := filepath.Join(dir, "prices?v=1#a%20b.db")
+	db, err := initDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var mode string
+	var timeout int
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" || timeout != 5000 {
+		t.Errorf("journal_mode %q, busy_timeout %d; want wal and 5000", mode, timeout)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("database not created at %q: %v", path, err)
+	}
+}
+
+func TestOpenDBReadOnly(t *testing.T) {
+	t.Run("missing file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "typo", "prices.db")
+		if db, err := openDBReadOnly(Config{DBPath: path}); err == nil {
+			db.Close()
+			t.Fatal("opened a database that doesn't exist")
+		}
+		if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+			t.Errorf("%s was created (stat: %v)", filepath.Dir(path), err)
+		}
+	})
+
+	t.Run("old schema", func(t *testing.T) {
+		db := openTestDB(t)
+		path := dbFile(t, db)
+		if _, err := db.Exec("DELETE FROM schema_migrations WHERE version = ?", migrations[len(migrations)-1].version); err != nil {
+			t.Fatal(err)
+		}
+		ro, err := openDBReadOnly(Config{DBPath: path})
+		if err == nil {
+			ro.Close()
+			t.Fatal("opened a database that still needs migrating")
+		}
+		if !strings.Contains(err.Error(), "run --migrate") {
+			t.Errorf("err = %v, want a pointer to --migrate", err)
+		}
+		if v, _ := schemaVersion(db); v != migrations[len(migrations)-2].version {
+			t.Errorf("schema version %d after the check; it must not migrate", v)
+		}
+	})
+
+	t.Run("current schema", func(t *testing.T) {
+		db := openTestDB(t)
+		start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		if err := savePrices(context.Background(), db, testRecords([]string{"bitcoin"}, 3, start)); err != nil {
+			t.Fatal(err)
+		}
+		ro, err := openDBReadOnly(Config{DBPath: dbFile(t, db)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ro.Close()
+		records, err := loadLatestRecords(ro)
+		if err != nil || len(records) != 1 || records[0].Price != 102 {
+			t.Errorf("latest = %+v, %v; want bitcoin at 102", records, err)
+		}
+		if _, err := ro.Exec("DELETE FROM prices"); err == nil {
+			t.Error("delete succeeded on a read-only database")
+		}
+	})
+}
+
+// dbFile is the path of the SQLite file behind db.
+func dbFile(t *testing.T, db *DB) string {
+	t.Helper()
+	var seq int
+	var name, file string
+	if err := db.QueryRow("PRAGMA database_list").Scan(&seq, &name, &file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
@@ -0,0 +1,800 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const defaultSMTPPort = 587
+
+// postJSON POSTs body to url with the shared client, aborting if ctx ends.
+func postJSON(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return httpClient.Do(req)
+}
+
+// === TELEGRAM ===
+
+// telegramAPIURL is a var so it can be pointed at a local stub server.
+var telegramAPIURL = "https://api.telegram.org"
+
+// telegramRequest is the sendMessage body. ChatID stays a string so numeric
+// and @channel ids both round-trip unchanged.
+type telegramRequest struct {
+	ChatID              string `json:"chat_id"`
+	Text                string `json:"text"`
+	ParseMode           string `json:"parse_mode,omitempty"`
+	DisableNotification bool   `json:"disable_notification,omitempty"`
+}
+
+// sendTelegramMessage sends msg to every configured chat, silently when
+// msg.silent says so.
+func sendTelegramMessage(ctx context.Context, cfg Config, msg message) error {
+	if cfg.TelegramToken == "" && cfg.TelegramChatID == "" {
+		return nil
+	}
+	chats := telegramChatIDs(cfg)
+	if cfg.TelegramToken == "" || len(chats) == 0 {
+		return errors.New("TELEGRAM_BOT_TOKEN or TELEGRAM_CHAT_ID not set")
+	}
+	mode := telegramParseMode(cfg)
+	parts := splitText(msg.Text, messageLimit(cfg, "telegram"), func(s string) int { return utf16Len(telegramText(mode, s)) })
+	var errs []error
+	for _, chat := range chats {
+		if err := sendTelegramParts(ctx, cfg, chat, parts, msg.silent(cfg)); err != nil {
+			slog.Warn("telegram chat failed", "event", "notify_error", "channel", "telegram", "chat", chat, "error", err)
+			errs = append(errs, fmt.Errorf("chat %s: %w", chat, err))
+		}
+	}
+	switch {
+	case len(errs) == 0:
+		return nil
+	case len(chats) == 1:
+		return errors.Unwrap(errs[0])
+	case len(errs) < len(chats):
+		// Some chats have it already; %v keeps the error from counting as
+		// retryable, so a retry or redelivery doesn't send them a duplicate.
+		return fmt.Errorf("%d of %d telegram chats failed: %v", len(errs), len(chats), errors.Join(errs...))
+	}
+	return errors.Join(errs...)
+}
+
+// telegramChatIDs splits TelegramChatID, which may list several chats
+// separated by commas.
+func telegramChatIDs(cfg Config) []string {
+	var out []string
+	for _, id := range strings.Split(cfg.TelegramChatID, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// sendTelegramParts sends the parts of one message to chat in order,
+// stopping at the first failure.
+func sendTelegramParts(ctx context.Context, cfg Config, chat string, parts []string, silent bool) error {
+	for _, p := range parts {
+		if err := sendTelegramChat(ctx, cfg, chat, p, silent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendTelegramChat(ctx context.Context, cfg Config, chat, text string, silent bool) error {
+	mode := telegramParseMode(cfg)
+	url := fmt.Sprintf("%s/bot%s/sendMessage", telegramAPIURL, cfg.TelegramToken)
+	payload := telegramRequest{
+		ChatID:              chat,
+		Text:                telegramText(mode, text),
+		ParseMode:           mode,
+		DisableNotification: silent,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := postJSON(ctx, url, body)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode != 200 {
+		return &statusError{Service: "telegram", Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// telegramParseModes are the accepted TelegramParseMode values. "none"
+// sends plain text without a parse_mode.
+var telegramParseModes = []string{"Markdown", "MarkdownV2", "HTML", "none"}
+
+// telegramParseMode returns the parse_mode to send, "" meaning none.
+func telegramParseMode(cfg Config) string {
+	switch cfg.TelegramParseMode {
+	case "":
+		return "Markdown"
+	case "none":
+		return ""
+	}
+	return cfg.TelegramParseMode
+}
+
+var (
+	// Messages mark bold with *...*; everything else is literal text.
+	boldRe = regexp.MustCompile(`\*([^*\n]+)\*`)
+
+	markdownEscaper   = strings.NewReplacer("_", `\_`, "*", `\*`, "`", "\\`", "[", `\[`)
+	markdownV2Escaper = strings.NewReplacer(
+		"_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`, "~", `\~`, "`", "\\`",
+		">", `\>`, "#", `\#`, "+", `\+`, "-", `\-`, "=", `\=`, "|", `\|`,
+		"{", `\{`, "}", `\}`, ".", `\.`, "!", `\!`, `\`, `\\`,
+	)
+)
+
+// telegramText escapes text for the parse mode so coin symbols or template
+// output containing markup characters can't break rendering. The *bold*
+// markers in our messages are kept as formatting; any other * is escaped.
+func telegramText(mode, text string) string {
+	var esc *strings.Replacer
+	switch mode {
+	case "Markdown":
+		esc = markdownEscaper
+	case "MarkdownV2":
+		esc = markdownV2Escaper
+	case "HTML":
+		return boldRe.ReplaceAllString(html.EscapeString(text), "<b>$1</b>")
+	default:
+		return text
+	}
+	return mapBold(text, func(s string) string { return "*" + esc.Replace(s) + "*" }, esc.Replace)
+}
+
+// mapBold rewrites text piecewise: the inside of each *bold* span through
+// bold and everything between spans through plain.
+func mapBold(text string, bold, plain func(string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range boldRe.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(plain(text[last:m[0]]))
+		b.WriteString(bold(text[m[2]:m[3]]))
+		last = m[1]
+	}
+	b.WriteString(plain(text[last:]))
+	return b.String()
+}
+
+// === MESSAGE LENGTH ===
+
+// defaultMessageLimits are the longest messages the channels accept, in
+// characters. Email has no limit unless one is configured.
+var defaultMessageLimits = map[string]int{"telegram": 4096, "slack": 40000, "discord": 2000}
+
+// messageLimit returns the configured or default limit for channel, 0
+// meaning none.
+func messageLimit(cfg Config, channel string) int {
+	if n := cfg.MessageLimits[channel]; n > 0 {
+		return n
+	}
+	return defaultMessageLimits[channel]
+}
+
+// truncateText cuts text to at most limit runes, ending it with an
+// ellipsis when anything was cut. A limit of 0 leaves it alone.
+func truncateText(text string, limit int) string {
+	if limit <= 0 || utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	r := []rune(text)
+	return string(r[:limit-1]) + "…"
+}
+
+// truncateLines is truncateText for text that is formatted after cutting:
+// it cuts at a line break where possible, so markup on a line stays paired,
+// and keeps size of the result, ellipsis included, within limit.
+func truncateLines(text string, limit int, size func(string) int) string {
+	if limit <= 0 || size(text) <= limit {
+		return text
+	}
+	return splitText(text, limit, func(s string) int { return size(s + "…") })[0] + "…"
+}
+
+// splitText breaks text into parts of at most limit as measured by size,
+// at line breaks where possible; a line too long on its own is cut where it
+// reaches the limit. A limit of 0 returns text as the only part.
+func splitText(text string, limit int, size func(string) int) []string {
+	if limit <= 0 || size(text) <= limit {
+		return []string{text}
+	}
+	var parts []string
+	cur := ""
+	flush := func() {
+		if p := strings.TrimRight(cur, "\n"); p != "" {
+			parts = append(parts, p)
+		}
+		cur = ""
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if size(cur+line) <= limit {
+			cur += line
+			continue
+		}
+		flush()
+		for size(line) > limit {
+			r := []rune(line)
+			// The longest prefix that fits; at least one rune so this ends.
+			n := max(1, sort.Search(len(r), func(i int) bool { return size(string(r[:i+1])) > limit }))
+			parts = append(parts, string(r[:n]))
+			line = string(r[n:])
+		}
+		cur = line
+	}
+	flush()
+	return parts
+}
+
+// utf16Len is the length of s in UTF-16 code units, which is how Telegram
+// counts message length.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n++
+		if r >= 0x10000 {
+			n++
+		}
+	}
+	return n
+}
+
+// === SLACK ===
+func sendSlackMessage(ctx context.Context, cfg Config, msg message) error {
+	if cfg.SlackWebhook == "" {
+		return nil
+	}
+	msg.Text = truncateText(msg.Text, messageLimit(cfg, "slack"))
+	var payload any = map[string]string{"text": msg.Text}
+	if cfg.SlackRichFormat && msg.Update != nil {
+		payload = slackUpdatePayload(msg)
+	}
+	body, _ := json.Marshal(payload)
+	resp, err := postJSON(ctx, cfg.SlackWebhook, body)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode >= 300 {
+		return &statusError{Service: "slack", Code: resp.StatusCode}
+	}
+	return nil
+}
+
+type slackPayload struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Fields   []slackField `json:"fields"`
+	Footer   string       `json:"footer"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// Attachment colors for a net rise, a net fall, and no change to compare.
+const (
+	slackColorUp   = "#2eb886"
+	slackColorDown = "#d50200"
+	slackColorFlat = "#a0a0a0"
+)
+
+// slackUpdatePayload renders the regular update as one attachment with a
+// field per coin, green or red by the net change across coins in the first
+// currency. The plain text stays as the fallback for notifications.
+func slackUpdatePayload(msg message) slackPayload {
+	data := msg.Update
+	att := slackAttachment{Fallback: msg.Text, Color: slackColorFlat, Footer: data.Time}
+	net, compared := 0.0, false
+	for _, c := range data.Coins {
+		var lines []string
+		for _, cur := range data.Currencies {
+			price, ok := c.Prices[cur]
+			if !ok {
+				continue
+			}
+			line := formatFixed(cur, price, c.Decimals[cur])
+			if change, ok := c.Changes[cur]; ok {
+				line = c.Trends[cur] + " " + line + " (" + formatChangeFixed(cur, change, c.Decimals[cur]) + ")"
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		att.Fields = append(att.Fields, slackField{Title: c.Symbol, Value: strings.Join(lines, "\n"), Short: true})
+		if pct, ok := c.changePercent(data.Currencies[0]); ok {
+			net += pct
+			compared = true
+		}
+	}
+	switch {
+	case compared && net > 0:
+		att.Color = slackColorUp
+	case compared && net < 0:
+		att.Color = slackColorDown
+	}
+	title := fmt.Sprintf("📊 *Crypto Prices (%s)*", strings.ToUpper(strings.Join(data.Currencies, ", ")))
+	return slackPayload{Text: title, Attachments: []slackAttachment{att}}
+}
+
+// === DISCORD ===
+
+// discordSuppressNotifications is the message flag that posts without a
+// push or desktop notification.
+const discordSuppressNotifications = 1 << 12
+
+// discordText turns the Telegram/Slack-style *bold* in text into Discord's
+// **bold**, escaping any other * so a cut-off span stays literal.
+func discordText(text string) string {
+	escape := func(s string) string { return strings.ReplaceAll(s, "*", `\*`) }
+	return mapBold(text, func(s string) string { return "**" + s + "**" }, escape)
+}
+
+func sendDiscordMessage(ctx context.Context, cfg Config, msg message) error {
+	if cfg.DiscordWebhook == "" {
+		return nil
+	}
+	text := truncateLines(msg.Text, messageLimit(cfg, "discord"), func(s string) int { return utf8.RuneCountInString(discordText(s)) })
+	content := discordText(text)
+	payload := map[string]any{"content": content}
+	if msg.silent(cfg) {
+		payload["flags"] = discordSuppressNotifications
+	}
+	body, _ := json.Marshal(payload)
+	resp, err := postJSON(ctx, cfg.DiscordWebhook, body)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode >= 300 {
+		return &statusError{Service: "discord", Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// === EMAIL ===
+
+// sendEmailMessage mails text to cfg.SMTPTo, as HTML when cfg.SMTPHTML is
+// set. It is a no-op when no SMTP host is configured.
+func sendEmailMessage(ctx context.Context, cfg Config, text string) error {
+	if cfg.SMTPHost == "" {
+		return nil
+	}
+	if cfg.SMTPFrom == "" || len(cfg.SMTPTo) == 0 {
+		return errors.New("smtp_from and smtp_to are required when smtp_host is set")
+	}
+	text = truncateText(text, messageLimit(cfg, "email"))
+	port := cfg.SMTPPort
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	addr := net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(port))
+
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+
+	contentType, body := "text/plain; charset=UTF-8", text
+	if cfg.SMTPHTML {
+		contentType = "text/html; charset=UTF-8"
+		body = "<html><body><p>" +
+			strings.ReplaceAll(boldRe.ReplaceAllString(html.EscapeString(text), "<b>$1</b>"), "\n", "<br>\n") +
+			"</p></body></html>"
+	}
+	subject := strings.SplitN(strings.ReplaceAll(text, "*", ""), "\n", 2)[0]
+	msg := "From: " + cfg.SMTPFrom + "\r\n" +
+		"To: " + strings.Join(cfg.SMTPTo, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("UTF-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+
+	err := sendMail(ctx, addr, cfg.SMTPHost, auth, cfg.SMTPFrom, cfg.SMTPTo, []byte(msg))
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) && (tpErr.Code == 535 || tpErr.Code == 534) {
+		return fmt.Errorf("smtp authentication failed for %q: %w", cfg.SMTPUsername, err)
+	}
+	return err
+}
+
+// sendMail does what smtp.SendMail does, but gives up as soon as ctx ends:
+// the connection is closed under the client, and the error is ctx's.
+func sendMail(ctx context.Context, addr, host string, auth smtp.Auth, from string, to []string, msg []byte) (err error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// === WEBHOOK ===
+
+// webhookPayload is the machine-readable body POSTed to GenericWebhook.
+// Changes holds the absolute change since the previous fetch and only has
+// entries where there was one.
+type webhookPayload struct {
+	Timestamp time.Time                     `json:"timestamp"`
+	Prices    map[string]map[string]float64 `json:"prices"`
+	Changes   map[string]map[string]float64 `json:"changes"`
+}
+
+// sendWebhook POSTs the fetched prices as JSON to cfg.GenericWebhook, for
+// services that want data rather than a chat message. No-op when unset.
+func sendWebhook(ctx context.Context, cfg Config, prices, lastPrices map[string]map[string]float64, fetchedAt time.Time) error {
+	if cfg.GenericWebhook == "" {
+		return nil
+	}
+	payload := webhookPayload{Timestamp: fetchedAt.UTC(), Prices: prices, Changes: map[string]map[string]float64{}}
+	for coin, byCur := range prices {
+		for cur, price := range byCur {
+			last := lastPrices[coin][cur]
+			if last <= 0 {
+				continue
+			}
+			if payload.Changes[coin] == nil {
+				payload.Changes[coin] = map[string]float64{}
+			}
+			payload.Changes[coin][cur] = price - last
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if cfg.DryRun {
+		slog.Info("[dry-run] webhook not sent", "event", "notify_dry_run", "channel", "webhook", "body", string(body))
+		return nil
+	}
+	resp, err := postJSON(ctx, cfg.GenericWebhook, body)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode >= 300 {
+		return &statusError{Service: "webhook", Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// === DISPATCH ===
+
+// message is one notification. Update is set on the regular price update
+// for channels that can render its data richly; Text is always set and is
+// what every other channel sends.
+type message struct {
+	Text     string
+	Update   *messageData
+	Priority priority
+}
+
+// priority tells channels how loudly to deliver a message. The regular
+// update is low, alerts are high, anything else normal.
+type priority int
+
+const (
+	priorityNormal priority = iota
+	priorityLow
+	priorityHigh
+)
+
+// silent reports whether msg should arrive without a sound, on the channels
+// that can do that: low-priority messages when cfg.SilentUpdates is set.
+func (m message) silent(cfg Config) bool {
+	return cfg.SilentUpdates && m.Priority == priorityLow
+}
+
+// notifier is one notification channel. enabled reports whether cfg
+// configures it at all, so unconfigured channels are neither sent to nor
+// counted when deciding whether a message was delivered. retry marks the
+// channels that RetryNotifications applies to.
+type notifier struct {
+	name    string
+	enabled func(Config) bool
+	send    func(context.Context, Config, message) error
+	retry   bool
+}
+
+var notifiers = []notifier{
+	{"telegram", func(c Config) bool { return c.TelegramToken != "" || c.TelegramChatID != "" }, sendTelegramMessage, true},
+	{"slack", func(c Config) bool { return c.SlackWebhook != "" }, sendSlackMessage, true},
+	{"discord", func(c Config) bool { return c.DiscordWebhook != "" }, sendDiscordMessage, false},
+	{"email", func(c Config) bool { return c.SMTPHost != "" }, textOnly(sendEmailMessage), false},
+}
+
+// textOnly adapts a sender that only ever sends the message text.
+func textOnly(send func(context.Context, Config, string) error) func(context.Context, Config, message) error {
+	return func(ctx context.Context, cfg Config, msg message) error { return send(ctx, cfg, msg.Text) }
+}
+
+func notifierByName(name string) (notifier, bool) {
+	for _, n := range notifiers {
+		if n.name == name {
+			return n, true
+		}
+	}
+	return notifier{}, false
+}
+
+const (
+	notifyAttempts = 3
+	notifyBackoff  = 500 * time.Millisecond
+)
+
+// sendCanceled reports whether err only happened because ctx ended: a
+// send cut short by shutdown rather than one that failed.
+func sendCanceled(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() != nil
+}
+
+// sendLogged sends msg through n once and logs the attempt to q, which may
+// be nil to skip logging.
+func sendLogged(ctx context.Context, cfg Config, q notificationQueue, n notifier, msg message) error {
+	start := now()
+	err := n.send(ctx, cfg, msg)
+	if q == nil {
+		return err
+	}
+	a := notificationAttempt{Channel: n.name, Text: msg.Text, Status: "sent", DurationMs: now().Sub(start).Milliseconds(), At: start}
+	switch {
+	case sendCanceled(ctx, err):
+		a.Status, a.Error = "canceled", err.Error()
+	case err != nil:
+		a.Status, a.Error = "failed", err.Error()
+	}
+	if lerr := q.LogNotification(a); lerr != nil {
+		slog.Warn("could not log notification", "event", "db_error", "channel", n.name, "error", lerr)
+	}
+	return err
+}
+
+// sendWithRetry sends through n, retrying retryable failures with a
+// doubling backoff when cfg.RetryNotifications is set and n supports it.
+// Every attempt is logged to q.
+func sendWithRetry(ctx context.Context, cfg Config, q notificationQueue, n notifier, msg message) error {
+	attempts := 1
+	if cfg.RetryNotifications && n.retry {
+		attempts = notifyAttempts
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if ctx.Err() != nil {
+				return err
+			}
+			backoff := notifyBackoff << (i - 1)
+			slog.Warn("notify attempt failed, retrying", "event", "notify_retry", "channel", n.name, "attempt", i, "backoff_ms", backoff.Milliseconds(), "error", err)
+			if err := sleepCtx(ctx, backoff); err != nil {
+				return err
+			}
+		}
+		if err = sendLogged(ctx, cfg, q, n, msg); err == nil || !isRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// notify sends msg to every configured channel concurrently, so a slow or
+// failing channel doesn't hold up the others. Each channel's result is logged
+// on its own. It returns an error only if no channel delivered.
+//
+// With cfg.RetryNotifications, a message that still fails with a retryable
+// error is put on q for redeliverNotifications, as plain text. Every attempt
+// is logged to q; q may be nil to skip logging and queueing. With
+// cfg.DryRun the message is logged instead and nothing is sent.
+func notify(ctx context.Context, cfg Config, q notificationQueue, msg message) error {
+	if cfg.DryRun {
+		slog.Info("[dry-run] notification not sent", "event", "notify_dry_run", "text", msg.Text)
+		return nil
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+		sent int
+		used int
+	)
+	for _, n := range notifiers {
+		if !n.enabled(cfg) {
+			continue
+		}
+		used++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := now()
+			err := sendWithRetry(ctx, cfg, q, n, msg)
+			ms := now().Sub(start).Milliseconds()
+			if err != nil && cfg.RetryNotifications && n.retry && isRetryable(err) && ctx.Err() == nil && q != nil {
+				if qerr := q.QueueNotification(n.name, msg.Text, err); qerr != nil {
+					slog.Warn("could not queue failed notification", "event", "db_error", "channel", n.name, "error", qerr)
+				} else {
+					slog.Info("queued notification for redelivery", "event", "notify_queued", "channel", n.name)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if sendCanceled(ctx, err) {
+				slog.Info("notification canceled", "event", "notify_canceled", "channel", n.name, "duration_ms", ms)
+				errs = append(errs, fmt.Errorf("%s: %w", n.name, err))
+				return
+			}
+			if err != nil {
+				slog.Error("notify failed", "event", "notify_error", "channel", n.name, "duration_ms", ms, "error", err)
+				notifyErrorsTotal.WithLabelValues(n.name).Inc()
+				errs = append(errs, fmt.Errorf("%s: %w", n.name, err))
+				return
+			}
+			slog.Info("notification sent", "event", "notify_ok", "channel", n.name, "duration_ms", ms)
+			sent++
+		}()
+	}
+	wg.Wait()
+	if used > 0 && sent == 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// testMessage is what --test-notify sends.
+const testMessage = "✅ test message from crypto-tracker"
+
+// testNotify sends testMessage through every configured channel, one try
+// each regardless of RetryNotifications, and writes each channel's result
+// to w. It returns an error if any channel failed or none is configured.
+func testNotify(ctx context.Context, cfg Config, w io.Writer) error {
+	var failed []string
+	used := 0
+	for _, n := range notifiers {
+		if !n.enabled(cfg) {
+			continue
+		}
+		used++
+		if err := n.send(ctx, cfg, message{Text: testMessage}); err != nil {
+			fmt.Fprintf(w, "%-10s FAILED: %v\n", n.name, err)
+			failed = append(failed, n.name)
+			continue
+		}
+		fmt.Fprintf(w, "%-10s ok\n", n.name)
+	}
+	switch {
+	case used == 0:
+		return errors.New("no notification channel configured")
+	case len(failed) > 0:
+		return fmt.Errorf("%d of %d channels failed: %s", len(failed), used, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// maxRedeliveryAttempts is how many times a queued notification is retried
+// before it is dropped.
+const maxRedeliveryAttempts = 10
+
+// redeliverNotifications resends queued notifications oldest first, one try
+// each. Once a channel fails again the rest of its queue waits for the next
+// call, since it is most likely still down.
+func redeliverNotifications(ctx context.Context, cfg Config, q notificationQueue) {
+	queued, err := q.PendingNotifications()
+	if err != nil {
+		slog.Warn("could not load failed notifications", "event", "db_error", "error", err)
+		return
+	}
+	down := map[string]bool{}
+	for _, f := range queued {
+		n, ok := notifierByName(f.Channel)
+		if !ok || !n.enabled(cfg) || f.Attempts >= maxRedeliveryAttempts {
+			slog.Warn("dropping queued notification", "event", "notify_dropped", "channel", f.Channel, "attempts", f.Attempts)
+			if err := q.DeleteNotification(f.ID); err != nil {
+				slog.Warn("could not delete failed notification", "event", "db_error", "error", err)
+			}
+			continue
+		}
+		if down[f.Channel] {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err := sendLogged(ctx, cfg, q, n, message{Text: f.Text}); err != nil {
+			if sendCanceled(ctx, err) {
+				slog.Info("redelivery canceled", "event", "notify_canceled", "channel", f.Channel)
+				return
+			}
+			down[f.Channel] = true
+			slog.Warn("redelivery failed", "event", "notify_redeliver_error", "channel", f.Channel, "attempts", f.Attempts+1, "error", err)
+			if err := q.RecordRedeliveryAttempt(f.ID, err); err != nil {
+				slog.Warn("could not update failed notification", "event", "db_error", "error", err)
+			}
+			continue
+		}
+		slog.Info("queued notification redelivered", "event", "notify_redelivered", "channel", f.Channel)
+		if err := q.DeleteNotification(f.ID); err != nil {
+			slog.Warn("could not delete failed notification", "event", "db_error", "error", err)
+		}
+	}
+}
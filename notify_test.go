@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestTelegramText(t *testing.T) {
+	// The header is bold; the symbol line carries Markdown, MarkdownV2 and
+	// HTML specials that must come through as literal text.
+	const text = "*Prices (USD)*\nB_T*C[x]: $1.50 <b>"
+	tests := []struct {
+		mode, want string
+	}{
+		{"Markdown", "*Prices (USD)*\nB\\_T\\*C\\[x]: $1.50 <b>"},
+		{"MarkdownV2", "*Prices \\(USD\\)*\nB\\_T\\*C\\[x\\]: $1\\.50 <b\\>"},
+		{"HTML", "<b>Prices (USD)</b>\nB_T*C[x]: $1.50 &lt;b&gt;"},
+		{"", text},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			if got := telegramText(tt.mode, text); got != tt.want {
+				t.Errorf("telegramText(%q) =\n%s\nwant\n%s", tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendTelegramChatJSON(t *testing.T) {
+	var got telegramRequest
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("body is not valid JSON: %v", err)
+		}
+	}))
+	defer srv.Close()
+	old := telegramAPIURL
+	telegramAPIURL = srv.URL
+	defer func() { telegramAPIURL = old }()
+
+	cfg := Config{TelegramToken: "123:abc", TelegramParseMode: "none"}
+	text := "say \"hi\"\nC:\\coins\\btc\ttab"
+	if err := sendTelegramChat(context.Background(), cfg, "-1001234567890", text, true); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/bot123:abc/sendMessage" {
+		t.Errorf("path = %q", path)
+	}
+	want := telegramRequest{ChatID: "-1001234567890", Text: text, DisableNotification: true}
+	if got != want {
+		t.Errorf("sent %+v, want %+v", got, want)
+	}
+}
+
+// longMessage is a bold header and n coin lines carrying markup characters.
+func longMessage(n int) string {
+	var b strings.Builder
+	b.WriteString("📊 *Crypto Prices (USD)*\nTime: 2026-01-02 08:00:00 UTC")
+	for i := range n {
+		fmt.Fprintf(&b, "\nC_%d.X: $1,234.50 (Δ -1.5%%)", i)
+	}
+	return b.String()
+}
+
+func TestTelegramSplitFormatted(t *testing.T) {
+	text := longMessage(40)
+	const limit = 200
+	for _, mode := range []string{"Markdown", "MarkdownV2", "HTML"} {
+		t.Run(mode, func(t *testing.T) {
+			parts := splitText(text, limit, func(s string) int { return utf16Len(telegramText(mode, s)) })
+			if len(parts) < 2 {
+				t.Fatalf("%d parts, want the message split", len(parts))
+			}
+			if got := strings.Join(parts, "\n"); got != text {
+				t.Errorf("parts don't rejoin to the message at line breaks")
+			}
+			for i, p := range parts {
+				if n := utf16Len(telegramText(mode, p)); n > limit {
+					t.Errorf("part %d is %d long once formatted, over %d", i, n, limit)
+				}
+			}
+		})
+	}
+}
+
+func TestDiscordTruncateKeepsBoldPaired(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Content string `json:"content"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		got = body.Content
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// The header alone fits the limit raw but not with ** doubled, so the
+	// cut must fall before it is split.
+	text := "*Crypto Prices (USD)*\n" + strings.Repeat("x", 10)
+	for _, limit := range []int{20, 23, 30, 60} {
+		cfg := Config{DiscordWebhook: srv.URL, MessageLimits: map[string]int{"discord": limit}}
+		if err := sendDiscordMessage(context.Background(), cfg, message{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+		if n := utf8.RuneCountInString(got); n > limit {
+			t.Errorf("limit %d: sent %d runes", limit, n)
+		}
+		if strings.Count(got, "**")%2 != 0 {
+			t.Errorf("limit %d: unpaired ** in %q", limit, got)
+		}
+	}
+}
+
+func TestDiscordStatusError(t *testing.T) {
+	tests := []struct {
+		code      int
+		retryable bool
+	}{
+		{http.StatusTooManyRequests, true},
+		{http.StatusBadGateway, true},
+		{http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.code)
+		}))
+		err := sendDiscordMessage(context.Background(), Config{DiscordWebhook: srv.URL}, message{Text: "hi"})
+		srv.Close()
+		var se *statusError
+		if !errors.As(err, &se) || se.Service != "discord" || se.Code != tt.code {
+			t.Errorf("%d: err = %v, want a discord statusError", tt.code, err)
+			continue
+		}
+		if got := isRetryable(err); got != tt.retryable {
+			t.Errorf("%d: retryable = %v, want %v", tt.code, got, tt.retryable)
+		}
+	}
+}
+
+func TestWebhookStatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	err := sendWebhook(context.Background(), Config{GenericWebhook: srv.URL}, map[string]map[string]float64{"bitcoin": {"usd": 1}}, nil, time.Now())
+	var se *statusError
+	if !errors.As(err, &se) || se.Service != "webhook" || se.Code != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want a webhook statusError", err)
+	}
+	if !isRetryable(err) {
+		t.Error("503 from the webhook not classed as retryable")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// === PORTFOLIO ===
+
+// portfolioValue is what Config.Holdings were worth at one fetch, in the
+// first configured currency.
+type portfolioValue struct {
+	Currency string    `json:"currency"`
+	Value    float64   `json:"value"`
+	At       time.Time `json:"at"`
+	// Change is against the previous fetch's prices, nil when a holding had
+	// no previous price to compare with.
+	Change *float64 `json:"change,omitempty"`
+}
+
+// valuePortfolio prices holdings in currency. Holdings for coins not in
+// coins are left out (see warnUntrackedHoldings); ok is false when there
+// are no holdings or a held coin's price is missing from prices.
+func valuePortfolio(holdings map[string]float64, coins []CoinSpec, currency string, prices, lastPrices map[string]map[string]float64, at time.Time) (v portfolioValue, ok bool) {
+	v = portfolioValue{Currency: currency, At: at}
+	var last float64
+	compared := true
+	held := 0
+	for id, amount := range holdings {
+		if !hasCoin(coins, id) {
+			continue
+		}
+		price, found := prices[id][currency]
+		if !found {
+			return portfolioValue{}, false
+		}
+		held++
+		v.Value += amount * price
+		if lp, found := lastPrices[id][currency]; found {
+			last += amount * lp
+		} else {
+			compared = false
+		}
+	}
+	if held == 0 {
+		return portfolioValue{}, false
+	}
+	if compared {
+		change := v.Value - last
+		v.Change = &change
+	}
+	return v, true
+}
+
+// warnUntrackedHoldings logs each holding whose coin isn't tracked, or is
+// disabled, since it can't be priced and is left out of the total.
+func warnUntrackedHoldings(cfg Config) {
+	active := activeCoins(cfg.Coins)
+	for id := range cfg.Holdings {
+		if !hasCoin(active, id) {
+			slog.Warn("holding skipped: coin is not tracked", "event", "portfolio_untracked", "coin", id)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// === QUIET HOURS ===
+
+// QuietHours is a daily window in which the regular update isn't sent to
+// the chat channels. Prices are still saved and the webhook still called.
+type QuietHours struct {
+	// Start and End are 24h local times, "22:00" and "07:30". A window with
+	// End before Start runs past midnight.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Timezone is the IANA zone Start and End are in. Empty uses the
+	// top-level Timezone.
+	Timezone string `json:"timezone,omitempty"`
+	// Alerts lists the alert kinds still sent during the window, out of
+	// alertKinds. Unset lets every alert through; [] holds them all back.
+	Alerts []string `json:"alerts"`
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether now falls in the window, read in the window's
+// zone or else in loc. A nil window is never active.
+func (q *QuietHours) active(now time.Time, loc *time.Location) bool {
+	if q == nil {
+		return false
+	}
+	if q.Timezone != "" {
+		if l, err := time.LoadLocation(q.Timezone); err == nil {
+			loc = l
+		}
+	}
+	start, err1 := parseClock(q.Start)
+	end, err2 := parseClock(q.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	t := now.In(loc)
+	m := t.Hour()*60 + t.Minute()
+	if start < end {
+		return start <= m && m < end
+	}
+	return m >= start || m < end
+}
+
+// allows reports whether an alert of kind is sent during the window.
+func (q *QuietHours) allows(kind string) bool {
+	return q == nil || q.Alerts == nil || slices.Contains(q.Alerts, kind)
+}
+
+// validateQuietHours rejects unparsable times, an empty window, an unknown
+// zone and unknown alert kinds.
+func validateQuietHours(q *QuietHours) error {
+	if q == nil {
+		return nil
+	}
+	var errs []error
+	start, err := parseClock(q.Start)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("quiet_hours.start: %w", err))
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("quiet_hours.end: %w", err))
+	}
+	if len(errs) == 0 && start == end {
+		errs = append(errs, errors.New("quiet_hours: start and end must differ"))
+	}
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		errs = append(errs, fmt.Errorf("quiet_hours.timezone: %w", err))
+	}
+	for i, kind := range q.Alerts {
+		if !slices.Contains(alertKinds, kind) {
+			errs = append(errs, fmt.Errorf("quiet_hours.alerts[%d] must be one of %s, got %q", i, strings.Join(alertKinds, ", "), kind))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	defaultHTTPPort = 8080
+	// defaultHealthIntervals is how many poll intervals may pass without a
+	// successful fetch before /healthz reports unhealthy.
+	defaultHealthIntervals = 3
+	defaultHistoryLimit    = 100
+	maxHistoryLimit        = 5000
+	defaultStatsWindow     = 24 * time.Hour
+	defaultCandleInterval  = time.Hour
+)
+
+// server exposes read-only views of the tracker over HTTP.
+type server struct {
+	cfg    atomic.Pointer[Config]
+	db     *DB
+	latest *PriceCache
+	health *jobHealth
+	hub    *priceHub
+}
+
+func newServer(cfg Config, db *DB, latest *PriceCache, health *jobHealth) *server {
+	s := &server{db: db, latest: latest, health: health, hub: newPriceHub()}
+	s.setConfig(cfg)
+	latest.OnSet(s.publish)
+	return s
+}
+
+// setConfig swaps in a reloaded config for subsequent requests.
+func (s *server) setConfig(cfg Config) { s.cfg.Store(&cfg) }
+
+func (s *server) config() Config { return *s.cfg.Load() }
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleDashboard)
+	mux.HandleFunc("GET /history", s.handleHistory)
+	mux.HandleFunc("GET /latest", s.handleLatest)
+	mux.HandleFunc("GET /coins", s.handleCoins)
+	mux.HandleFunc("GET /ws", s.handleWS)
+	mux.HandleFunc("GET /stats", s.handleStats)
+	mux.HandleFunc("GET /candles", s.handleCandles)
+	mux.HandleFunc("GET /export.csv", s.handleExportCSV)
+	mux.HandleFunc("GET /portfolio/history", s.handlePortfolioHistory)
+	mux.HandleFunc("GET /notifications", s.handleNotifications)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	return mux
+}
+
+// handleHistory serves GET /history?coin=bitcoin&from=...&to=...&limit=N&order=asc|desc.
+// from and to are RFC3339 timestamps and both optional.
+func (s *server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	coin, from, to, ok := s.coinRangeParams(w, q)
+	if !ok {
+		return
+	}
+	var err error
+	limit := defaultHistoryLimit
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(limit, maxHistoryLimit)
+	}
+	order := "DESC"
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		order = "ASC"
+	default:
+		writeError(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(),
+		`SELECT coin, currency, price_usd, created_at, market_cap, volume_24h, change_24h, COALESCE(source, '') FROM prices
+		WHERE coin = ? AND created_at >= ? AND created_at <= ?
+		ORDER BY created_at `+order+` LIMIT ?`,
+		coin, from.UTC().Format(sqliteTime), to.UTC().Format(sqliteTime), limit)
+	if err != nil {
+		slog.Error("history query failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "query failed")
+		return
+	}
+	defer rows.Close()
+
+	out := []PriceRecord{}
+	for rows.Next() {
+		var row PriceRecord
+		if err := rows.Scan(&row.Coin, &row.Currency, &row.Price, &row.FetchedAt, &row.MarketCap, &row.Volume24h, &row.Change24h, &row.Source); err != nil {
+			slog.Error("history scan failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+			writeError(w, http.StatusInternalServerError, "query failed")
+			return
+		}
+		out = append(out, row)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("history query failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "query failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// latestResponse is the cached fetch. Display has each price formatted as
+// in messages, with the coin's decimals. Stale is set once it is older than
+// /healthz tolerates, meaning fetches have been failing.
+type latestResponse struct {
+	Prices    map[string]map[string]float64    `json:"prices"`
+	Display   map[string]map[string]string     `json:"display"`
+	Market    map[string]map[string]marketData `json:"market,omitempty"`
+	FetchedAt time.Time                        `json:"fetched_at"`
+	Stale     bool                             `json:"stale"`
+}
+
+// coinResponse is one configured coin. Decimals is null for coins whose
+// precision follows the price.
+type coinResponse struct {
+	ID       string `json:"id"`
+	Symbol   string `json:"symbol"`
+	Emoji    string `json:"emoji,omitempty"`
+	Decimals *int   `json:"decimals"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// handleCoins serves GET /coins: every configured coin in config order,
+// disabled ones included.
+func (s *server) handleCoins(w http.ResponseWriter, r *http.Request) {
+	coins := s.config().Coins
+	out := make([]coinResponse, len(coins))
+	for i, c := range coins {
+		out[i] = coinResponse{ID: c.ID, Symbol: coinSymbol(c), Emoji: c.Emoji, Decimals: c.Decimals, Enabled: c.enabled()}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleLatest serves GET /latest from the price cache, without touching the DB.
+func (s *server) handleLatest(w http.ResponseWriter, r *http.Request) {
+	snap := s.latest.GetAll()
+	if snap.FetchedAt.IsZero() {
+		writeError(w, http.StatusServiceUnavailable, "no successful fetch yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.latestResponse(snap))
+}
+
+func (s *server) latestResponse(snap priceSnapshot) latestResponse {
+	cfg := s.config()
+	display := map[string]map[string]string{}
+	for id, byCur := range snap.Prices {
+		c := coinByID(cfg.Coins, id)
+		display[id] = map[string]string{}
+		for cur, price := range byCur {
+			display[id][cur] = formatFixed(cur, price, priceDecimals(cfg, c, cur, price))
+		}
+	}
+	return latestResponse{Prices: snap.Prices, Display: display, Market: snap.Market, FetchedAt: snap.FetchedAt, Stale: snap.Stale}
+}
+
+type healthResponse struct {
+	Status      string         `json:"status"`
+	LastFetch   *time.Time     `json:"last_fetch"`
+	Source      string         `json:"source,omitempty"`
+	LastError   string         `json:"last_error,omitempty"`
+	LastErrorAt *time.Time     `json:"last_error_at,omitempty"`
+	LastRun     *fetchRun      `json:"last_run,omitempty"`
+	Breaker     *breakerStatus `json:"breaker,omitempty"`
+	SaveError   string         `json:"save_error,omitempty"`
+	SaveErrorAt *time.Time     `json:"save_error_at,omitempty"`
+}
+
+// handleHealthz serves GET /healthz: 200 while fetches keep succeeding, 503
+// once none has succeeded within the last few poll intervals. While the
+// latest save failed it reports "degraded" with the error, still with 200 as
+// long as fetches succeed. The price source's circuit breaker state, and
+// which source served the latest fetch, are included either way.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	lastSuccess, lastError, lastErrorAt := s.health.snapshot()
+
+	resp := healthResponse{Status: "ok", Source: s.health.activeSource(), LastError: lastError, LastRun: s.health.latestRun()}
+	if s.health.breaker != nil {
+		st := s.health.breaker.status()
+		resp.Breaker = &st
+	}
+	if !lastSuccess.IsZero() {
+		resp.LastFetch = &lastSuccess
+	}
+	if !lastErrorAt.IsZero() {
+		resp.LastErrorAt = &lastErrorAt
+	}
+	if saveError, at := s.health.saveState(); saveError != "" {
+		resp.Status = "degraded"
+		resp.SaveError, resp.SaveErrorAt = saveError, &at
+	}
+	code := http.StatusOK
+	if lastSuccess.IsZero() || now().Sub(lastSuccess) > healthWindow(s.config()) {
+		resp.Status = "unhealthy"
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, resp)
+}
+
+// healthWindow is how long /healthz tolerates no successful fetch:
+// HealthMaxIntervals poll intervals.
+func healthWindow(cfg Config) time.Duration {
+	interval, _ := pollInterval(cfg)
+	n := cfg.HealthMaxIntervals
+	if n <= 0 {
+		n = defaultHealthIntervals
+	}
+	return time.Duration(n) * interval
+}
+
+// statsResponse aggregates one coin's prices over [From, To]. The price
+// fields are null when the window holds no samples.
+type statsResponse struct {
+	Coin     string    `json:"coin"`
+	Currency string    `json:"currency"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Count    int       `json:"count"`
+	Min      *float64  `json:"min"`
+	Max      *float64  `json:"max"`
+	Avg      *float64  `json:"avg"`
+	Latest   *float64  `json:"latest"`
+}
+
+// handleStats serves GET /stats?coin=bitcoin&window=24h&currency=usd.
+// window is a Go duration ending now, 24h by default; currency defaults to
+// the first configured one.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	coin := q.Get("coin")
+	if !hasCoin(s.config().Coins, coin) {
+		writeError(w, http.StatusBadRequest, "unknown coin: "+strconv.Quote(coin))
+		return
+	}
+	window := defaultStatsWindow
+	if v := q.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "window must be a positive duration like 24h")
+			return
+		}
+		window = d
+	}
+	currency := q.Get("currency")
+	if currency == "" {
+		currency = s.config().Currencies[0]
+	}
+
+	to := now().UTC().Truncate(time.Second)
+	resp := statsResponse{Coin: coin, Currency: currency, From: to.Add(-window), To: to}
+	args := []any{coin, currency, resp.From.Format(sqliteTime), resp.To.Format(sqliteTime)}
+	var lo, hi, avg sql.NullFloat64
+	err := s.db.QueryRowContext(r.Context(),
+		`SELECT COUNT(*), MIN(price_usd), MAX(price_usd), AVG(price_usd) FROM prices
+		WHERE coin = ? AND currency = ? AND created_at >= ? AND created_at <= ?`,
+		args...).Scan(&resp.Count, &lo, &hi, &avg)
+	if err != nil {
+		slog.Error("stats query failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "query failed")
+		return
+	}
+	if resp.Count > 0 {
+		// The window ends now, so a fresh cached fetch inside it is the latest
+		// stored price and saves the second query.
+		snap := s.latest.GetAll()
+		latest, cached := snap.Prices[coin][currency]
+		if !cached || snap.Stale || snap.FetchedAt.Before(resp.From) {
+			err := s.db.QueryRowContext(r.Context(),
+				`SELECT price_usd FROM prices
+				WHERE coin = ? AND currency = ? AND created_at >= ? AND created_at <= ?
+				ORDER BY created_at DESC LIMIT 1`,
+				args...).Scan(&latest)
+			if err != nil {
+				slog.Error("stats query failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+				writeError(w, http.StatusInternalServerError, "query failed")
+				return
+			}
+		}
+		resp.Min, resp.Max, resp.Avg, resp.Latest = &lo.Float64, &hi.Float64, &avg.Float64, &latest
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handlePortfolioHistory serves GET /portfolio/history?from=...&to=...&limit=N,
+// oldest first for charting. from and to are RFC3339 timestamps and both
+// optional; limit keeps the newest N points.
+func (s *server) handlePortfolioHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, err := parseTimeParam(q.Get("from"), time.Time{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad from: "+err.Error())
+		return
+	}
+	to, err := parseTimeParam(q.Get("to"), now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad to: "+err.Error())
+		return
+	}
+	limit := defaultHistoryLimit
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(limit, maxHistoryLimit)
+	}
+
+	rows, err := s.db.QueryContext(r.Context(),
+		`SELECT currency, value, created_at FROM portfolio_value
+		WHERE created_at >= ? AND created_at <= ?
+		ORDER BY created_at DESC LIMIT ?`,
+		from.UTC().Format(sqliteTime), to.UTC().Format(sqliteTime), limit)
+	if err != nil {
+		slog.Error("portfolio query failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "query failed")
+		return
+	}
+	defer rows.Close()
+
+	out := []portfolioValue{}
+	for rows.Next() {
+		var v portfolioValue
+		if err := rows.Scan(&v.Currency, &v.Value, &v.At); err != nil {
+			slog.Error("portfolio scan failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+			writeError(w, http.StatusInternalServerError, "query failed")
+			return
+		}
+		out = append(out, v)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("portfolio query failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "query failed")
+		return
+	}
+	slices.Reverse(out)
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleNotifications serves GET /notifications?limit=N: the last N logged
+// send attempts across all channels, newest first.
+func (s *server) handleNotifications(w http.ResponseWriter, r *http.Request) {
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(limit, maxHistoryLimit)
+	}
+	out, err := loadNotifications(r.Context(), s.db, limit)
+	if err != nil {
+		slog.Error("notifications query failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "query failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleCandles serves GET /candles?coin=bitcoin&interval=1h&from=...&to=...&currency=usd&empty=skip|carry.
+// interval is a Go duration of at least a minute, 1h by default. empty=carry
+// fills buckets without prices from the previous close instead of leaving
+// them out.
+func (s *server) handleCandles(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	coin, from, to, ok := s.coinRangeParams(w, q)
+	if !ok {
+		return
+	}
+	interval := defaultCandleInterval
+	if v := q.Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			writeError(w, http.StatusBadRequest, "interval must be a duration of at least 1m, like 1h")
+			return
+		}
+		interval = d
+	}
+	var carry bool
+	switch q.Get("empty") {
+	case "", "skip":
+	case "carry":
+		carry = true
+	default:
+		writeError(w, http.StatusBadRequest, "empty must be skip or carry")
+		return
+	}
+	currency := q.Get("currency")
+	if currency == "" {
+		currency = s.config().Currencies[0]
+	}
+
+	candles, err := buildCandles(s.db, coin, currency, interval, from, to, carry)
+	if errors.Is(err, errTooManyCandles) {
+		writeError(w, http.StatusBadRequest, err.Error()+"; narrow from/to or use a longer interval")
+		return
+	}
+	if err != nil {
+		slog.Error("candles query failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "query failed")
+		return
+	}
+	if candles == nil {
+		candles = []Candle{}
+	}
+	writeJSON(w, http.StatusOK, candles)
+}
+
+// coinRangeParams reads the coin, from and to query parameters shared by
+// the history-style endpoints, writing a 400 and returning ok=false if any
+// is invalid.
+func (s *server) coinRangeParams(w http.ResponseWriter, q url.Values) (coin string, from, to time.Time, ok bool) {
+	coin = q.Get("coin")
+	if !hasCoin(s.config().Coins, coin) {
+		writeError(w, http.StatusBadRequest, "unknown coin: "+strconv.Quote(coin))
+		return "", time.Time{}, time.Time{}, false
+	}
+	from, err := parseTimeParam(q.Get("from"), time.Time{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad from: "+err.Error())
+		return "", time.Time{}, time.Time{}, false
+	}
+	to, err = parseTimeParam(q.Get("to"), now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad to: "+err.Error())
+		return "", time.Time{}, time.Time{}, false
+	}
+	return coin, from, to, true
+}
+
+// handleExportCSV serves GET /export.csv?coin=...&from=...&to=...&currency=...
+// as a file download. Rows are streamed straight from the query so large
+// exports aren't buffered. currency defaults to the first configured one.
+func (s *server) handleExportCSV(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	coin, from, to, ok := s.coinRangeParams(w, q)
+	if !ok {
+		return
+	}
+	currency := q.Get("currency")
+	if currency == "" {
+		currency = s.config().Currencies[0]
+	}
+
+	rows, err := s.db.QueryContext(r.Context(),
+		`SELECT coin, price_usd, created_at FROM prices
+		WHERE coin = ? AND currency = ? AND created_at >= ? AND created_at <= ?
+		ORDER BY created_at ASC`,
+		coin, currency, from.UTC().Format(sqliteTime), to.UTC().Format(sqliteTime))
+	if err != nil {
+		slog.Error("export query failed", "event", "http_query_error", "path", r.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "query failed")
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.csv"`, coin, currency))
+	if err := writePricesCSV(w, rows); err != nil {
+		// Headers are already sent, so all we can do is log and stop.
+		slog.Error("export failed mid-stream", "event", "http_query_error", "path", r.URL.Path, "error", err)
+	}
+}
+
+// writePricesCSV streams (coin, price, created_at) rows as CSV with a header.
+func writePricesCSV(w io.Writer, rows *sql.Rows) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"coin", "price_usd", "created_at"}); err != nil {
+		return err
+	}
+	for rows.Next() {
+		var (
+			coin  string
+			price float64
+			at    time.Time
+		)
+		if err := rows.Scan(&coin, &price, &at); err != nil {
+			return err
+		}
+		if err := cw.Write([]string{coin, strconv.FormatFloat(price, 'f', -1, 64), at.UTC().Format(time.RFC3339)}); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// parseTimeParam parses an RFC3339 query value, returning def when it's empty.
+func parseTimeParam(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("write response failed", "event", "http_write_error", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,878 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// === FETCH PRICES ===
+
+// PriceSource is an upstream price API. Fetch returns prices keyed by coin
+// id, then by currency. Coins or currencies absent from the response are
+// skipped and listed in the result's Missing as "coin/currency"; it only
+// fails outright when nothing came back.
+type PriceSource interface {
+	Name() string
+	Fetch(ctx context.Context, coins []CoinSpec, currencies []string) (fetchResult, error)
+}
+
+// fetchResult is one successful Fetch. Market has the same keys as Prices
+// and is only filled in for the market fields enabled in the config. Source
+// is set by fetchWithFallback to the name of the source that served it.
+type fetchResult struct {
+	Prices  map[string]map[string]float64
+	Market  map[string]map[string]marketData
+	Missing []string
+	Source  string
+}
+
+// marketData is the optional per-coin market snapshot fetched alongside the
+// price. A nil field wasn't requested or wasn't in the response.
+type marketData struct {
+	MarketCap *float64 `json:"market_cap,omitempty"`
+	Volume24h *float64 `json:"volume_24h,omitempty"`
+	// Change24h is the upstream 24h price change, in percent.
+	Change24h *float64 `json:"change_24h,omitempty"`
+}
+
+// marketFields are the market data fields the config asks for.
+type marketFields struct {
+	MarketCap bool
+	Volume    bool
+	Change    bool
+}
+
+func marketFieldsFrom(cfg Config) marketFields {
+	return marketFields{MarketCap: cfg.IncludeMarketCap, Volume: cfg.Include24hVolume, Change: cfg.Include24hChange}
+}
+
+func (f marketFields) any() bool { return f.MarketCap || f.Volume || f.Change }
+
+// priceSources are the accepted Source and Sources values.
+var priceSources = []string{"coingecko", "coinmarketcap", "cryptocompare"}
+
+// newPriceSource returns the source called name, CoinGecko for "".
+func newPriceSource(cfg Config, name string) PriceSource {
+	switch name {
+	case "coinmarketcap":
+		return coinMarketCapSource{apiKey: cfg.CoinMarketCapAPIKey, fields: marketFieldsFrom(cfg)}
+	case "cryptocompare":
+		return cryptoCompareSource{apiKey: cfg.CryptoCompareAPIKey, fields: marketFieldsFrom(cfg)}
+	}
+	return coinGeckoSource{cfg: cfg}
+}
+
+// sourceNames is the order sources are tried in: cfg.Sources, or else
+// cfg.Source alone, CoinGecko by default.
+func sourceNames(cfg Config) []string {
+	if len(cfg.Sources) > 0 {
+		return cfg.Sources
+	}
+	if cfg.Source != "" {
+		return []string{cfg.Source}
+	}
+	return []string{"coingecko"}
+}
+
+// newPriceSources returns cfg's sources in the order they are tried.
+func newPriceSources(cfg Config) []PriceSource {
+	var out []PriceSource
+	for _, name := range sourceNames(cfg) {
+		out = append(out, newPriceSource(cfg, name))
+	}
+	return out
+}
+
+func validateSources(cfg Config) error {
+	if cfg.Source != "" && len(cfg.Sources) > 0 {
+		return errors.New("set either source or sources, not both")
+	}
+	var errs []error
+	seen := map[string]bool{}
+	for _, name := range sourceNames(cfg) {
+		switch {
+		case !slices.Contains(priceSources, name):
+			errs = append(errs, fmt.Errorf("source must be one of %s, got %q", strings.Join(priceSources, ", "), name))
+		case seen[name]:
+			errs = append(errs, fmt.Errorf("sources lists %q more than once", name))
+		case name == "coinmarketcap" && cfg.CoinMarketCapAPIKey == "":
+			errs = append(errs, errors.New("coinmarketcap_api_key is required when source is coinmarketcap"))
+		}
+		seen[name] = true
+	}
+	return errors.Join(errs...)
+}
+
+// fetchWithFallback fetches from each source in turn, with retries, until
+// one returns prices, and sets the result's Source to it. If every source
+// fails their errors are joined; a lone source's is returned as it is.
+func fetchWithFallback(ctx context.Context, cfg Config, sources []PriceSource) (fetchResult, error) {
+	var errs []error
+	for i, src := range sources {
+		res, err := fetchPricesWithRetry(ctx, cfg, src)
+		if err == nil {
+			res.Source = src.Name()
+			return res, nil
+		}
+		if len(sources) == 1 {
+			return fetchResult{}, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", src.Name(), err))
+		if ctx.Err() != nil {
+			break
+		}
+		if i+1 < len(sources) {
+			slog.Warn("price source failed, trying the next", "event", "fetch_fallback", "source", src.Name(), "next", sources[i+1].Name(), "error", err)
+		}
+	}
+	return fetchResult{}, errors.Join(errs...)
+}
+
+// collectPrices builds a Fetch result from a per-coin, per-currency lookup
+// into a decoded response. market is called for each price found, and only
+// when some market field is enabled.
+func collectPrices(source string, coins []CoinSpec, currencies []string, fields marketFields, lookup func(c CoinSpec, cur string) (float64, bool), market func(c CoinSpec, cur string) marketData) (fetchResult, error) {
+	res := fetchResult{Prices: map[string]map[string]float64{}}
+	if fields.any() {
+		res.Market = map[string]map[string]marketData{}
+	}
+	for _, c := range coins {
+		got := map[string]float64{}
+		for _, cur := range currencies {
+			v, ok := lookup(c, cur)
+			if !ok {
+				res.Missing = append(res.Missing, c.ID+"/"+cur)
+				continue
+			}
+			got[cur] = v
+			if fields.any() {
+				if res.Market[c.ID] == nil {
+					res.Market[c.ID] = map[string]marketData{}
+				}
+				res.Market[c.ID][cur] = market(c, cur)
+			}
+		}
+		if len(got) > 0 {
+			res.Prices[c.ID] = got
+		}
+	}
+	if len(res.Prices) == 0 {
+		return fetchResult{Missing: res.Missing}, fmt.Errorf("no prices in %s response for %s", source, strings.Join(coinIDs(coins), ", "))
+	}
+	return res, nil
+}
+
+// fieldValue returns a pointer to v for an enabled field that was present.
+func fieldValue(enabled bool, v float64, ok bool) *float64 {
+	if !enabled || !ok {
+		return nil
+	}
+	return &v
+}
+
+// === COINGECKO ===
+
+// CoinGecko endpoints. These are vars rather than consts so they can be
+// pointed at a local stub server.
+var (
+	coinGeckoPublicURL = "https://api.coingecko.com/api/v3"
+	coinGeckoProURL    = "https://pro-api.coingecko.com/api/v3"
+)
+
+type PriceResponse map[string]map[string]float64
+
+// coinGeckoBaseURL picks the Pro endpoint when an API key is configured.
+func coinGeckoBaseURL(cfg Config) string {
+	if cfg.CoinGeckoAPIKey != "" {
+		return coinGeckoProURL
+	}
+	return coinGeckoPublicURL
+}
+
+// coinGeckoLimiter spaces out every CoinGecko request, whichever code path
+// makes it. main sets its interval from the config.
+var coinGeckoLimiter = &minIntervalLimiter{interval: defaultCoinGeckoMinInterval}
+
+const (
+	// defaultCoinGeckoMinInterval keeps us at 30 calls a minute, the free
+	// tier's limit.
+	defaultCoinGeckoMinInterval = 2 * time.Second
+	// maxRateLimitWait is the longest a request blocks for its turn before
+	// giving up with errRateLimited.
+	maxRateLimitWait = 30 * time.Second
+)
+
+// coinGeckoThrottle stretches the poll interval while CoinGecko is rate
+// limiting us; main applies it to the ticker after every job.
+var coinGeckoThrottle = &throttle{factor: 1}
+
+const (
+	// maxThrottleFactor caps how far the poll interval is stretched.
+	maxThrottleFactor = 8
+	// rateLimitLowWater is the fraction of the quota left at which we start
+	// slowing down before CoinGecko answers 429.
+	rateLimitLowWater = 0.1
+)
+
+// coinGeckoGet issues a GET for path (including any query string) against
+// the configured CoinGecko endpoint, attaching the API key if there is one.
+func coinGeckoGet(ctx context.Context, cfg Config, path string) (*http.Response, error) {
+	if err := coinGeckoLimiter.wait(ctx, maxRateLimitWait); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, coinGeckoBaseURL(cfg)+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CoinGeckoAPIKey != "" {
+		req.Header.Set("x-cg-pro-api-key", cfg.CoinGeckoAPIKey)
+	}
+	// Asking for gzip ourselves turns off the transport's transparent
+	// decoding, which would hide how much was actually transferred.
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		resp.Body = &gzipBody{raw: resp.Body, endpoint: req.URL.Path}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+	observeCoinGeckoRateLimit(resp)
+	return resp, nil
+}
+
+// gzipBody decodes a gzip response body as it is read, and on Close logs
+// how many bytes came over the wire against how many they decoded to.
+type gzipBody struct {
+	raw      io.ReadCloser
+	endpoint string
+	zr       *gzip.Reader
+	err      error
+	wire     int64
+	decoded  int64
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil && b.err == nil {
+		b.zr, b.err = gzip.NewReader(countingReader{r: b.raw, n: &b.wire})
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.zr.Read(p)
+	b.decoded += int64(n)
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	if b.decoded > 0 {
+		slog.Info("CoinGecko response decoded", "event", "coingecko_gzip", "endpoint", b.endpoint,
+			"compressed_bytes", b.wire, "decoded_bytes", b.decoded)
+	}
+	return b.raw.Close()
+}
+
+// countingReader adds the bytes read through it to *n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// observeCoinGeckoRateLimit reacts to a response: a 429 holds every
+// CoinGecko request until its Retry-After, and it or a nearly used up quota
+// marks the job as rate limited so polling slows down.
+func observeCoinGeckoRateLimit(resp *http.Response) {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		wait := retryAfter(resp.Header, time.Now())
+		coinGeckoLimiter.holdUntil(time.Now().Add(wait))
+		coinGeckoThrottle.limit()
+		slog.Warn("CoinGecko rate limited us", "event", "rate_limited", "retry_after_s", wait.Seconds())
+	case nearRateLimit(resp.Header):
+		coinGeckoThrottle.limit()
+		slog.Warn("CoinGecko quota nearly used up", "event", "rate_limit_low",
+			"remaining", resp.Header.Get("X-RateLimit-Remaining"), "limit", resp.Header.Get("X-RateLimit-Limit"))
+	}
+}
+
+// retryAfter parses a Retry-After header given either as seconds or as an
+// HTTP date. It returns 0 when the header is missing or unparseable.
+func retryAfter(h http.Header, now time.Time) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(0, time.Duration(secs)*time.Second)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(0, t.Sub(now))
+	}
+	return 0
+}
+
+// nearRateLimit reports whether the X-RateLimit-Remaining/-Limit headers
+// show less than rateLimitLowWater of the quota left.
+func nearRateLimit(h http.Header) bool {
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return false
+	}
+	limit, err := strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	if err != nil || limit <= 0 {
+		return remaining <= 1
+	}
+	return float64(remaining) < float64(limit)*rateLimitLowWater
+}
+
+type coinGeckoSource struct {
+	cfg Config
+}
+
+func (coinGeckoSource) Name() string { return "coingecko" }
+
+func (s coinGeckoSource) Fetch(ctx context.Context, coins []CoinSpec, currencies []string) (fetchResult, error) {
+	fields := marketFieldsFrom(s.cfg)
+	q := url.Values{}
+	q.Set("ids", strings.Join(coinIDs(coins), ","))
+	q.Set("vs_currencies", strings.Join(currencies, ","))
+	if fields.MarketCap {
+		q.Set("include_market_cap", "true")
+	}
+	if fields.Volume {
+		q.Set("include_24hr_vol", "true")
+	}
+	if fields.Change {
+		q.Set("include_24hr_change", "true")
+	}
+	resp, err := coinGeckoGet(ctx, s.cfg, "/simple/price?"+q.Encode())
+	if err != nil {
+		return fetchResult{}, err
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode != 200 {
+		return fetchResult{}, &statusError{Service: "coingecko", Code: resp.StatusCode, RetryAfter: retryAfter(resp.Header, time.Now())}
+	}
+
+	// Market fields arrive next to the price as "<currency>_market_cap" etc.
+	var data PriceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return fetchResult{}, err
+	}
+	return collectPrices("coingecko", coins, currencies, fields, func(c CoinSpec, cur string) (float64, bool) {
+		v, ok := data[c.ID][cur]
+		return v, ok
+	}, func(c CoinSpec, cur string) marketData {
+		mcap, mok := data[c.ID][cur+"_market_cap"]
+		vol, vok := data[c.ID][cur+"_24h_vol"]
+		change, cok := data[c.ID][cur+"_24h_change"]
+		return marketData{
+			MarketCap: fieldValue(fields.MarketCap, mcap, mok),
+			Volume24h: fieldValue(fields.Volume, vol, vok),
+			Change24h: fieldValue(fields.Change, change, cok),
+		}
+	})
+}
+
+// marketChartResponse is the part of /coins/{id}/market_chart we use: a list
+// of [unix ms, price] pairs.
+type marketChartResponse struct {
+	Prices [][2]float64 `json:"prices"`
+}
+
+// fetchMarketChart returns coin's price history in currency over the last
+// days days as records stamped with their original times. CoinGecko picks
+// the granularity: 5-minutely for 1 day, hourly up to 90, daily beyond.
+func fetchMarketChart(ctx context.Context, cfg Config, coin, currency string, days int) ([]PriceRecord, error) {
+	q := url.Values{}
+	q.Set("vs_currency", currency)
+	q.Set("days", strconv.Itoa(days))
+	resp, err := coinGeckoGet(ctx, cfg, "/coins/"+url.PathEscape(coin)+"/market_chart?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode != 200 {
+		return nil, &statusError{Service: "coingecko", Code: resp.StatusCode}
+	}
+
+	var data marketChartResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	records := make([]PriceRecord, 0, len(data.Prices))
+	for _, p := range data.Prices {
+		records = append(records, PriceRecord{
+			Coin:      coin,
+			Currency:  currency,
+			Price:     p[1],
+			FetchedAt: time.UnixMilli(int64(p[0])).UTC(),
+			Source:    "coingecko",
+		})
+	}
+	return records, nil
+}
+
+// === COINMARKETCAP ===
+
+// coinMarketCapURL is a var so it can be pointed at a local stub server.
+var coinMarketCapURL = "https://pro-api.coinmarketcap.com"
+
+// coinMarketCapSource looks coins up by slug, which is CoinSpec.CMCSlug or
+// the CoinGecko id when that's unset (they agree for most coins).
+type coinMarketCapSource struct {
+	apiKey string
+	fields marketFields
+}
+
+type cmcQuotesResponse struct {
+	Data map[string]struct {
+		Slug  string              `json:"slug"`
+		Quote map[string]cmcQuote `json:"quote"`
+	} `json:"data"`
+}
+
+// cmcQuote is one currency's quote. CoinMarketCap always sends the market
+// fields; fields.* decide which of them we keep.
+type cmcQuote struct {
+	Price     float64 `json:"price"`
+	MarketCap float64 `json:"market_cap"`
+	Volume24h float64 `json:"volume_24h"`
+	Change24h float64 `json:"percent_change_24h"`
+}
+
+func (coinMarketCapSource) Name() string { return "coinmarketcap" }
+
+func (s coinMarketCapSource) Fetch(ctx context.Context, coins []CoinSpec, currencies []string) (fetchResult, error) {
+	slugs := make([]string, 0, len(coins))
+	for _, c := range coins {
+		slugs = append(slugs, cmcSlug(c))
+	}
+	q := url.Values{}
+	q.Set("slug", strings.Join(slugs, ","))
+	q.Set("convert", strings.ToUpper(strings.Join(currencies, ",")))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, coinMarketCapURL+"/v1/cryptocurrency/quotes/latest?"+q.Encode(), nil)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	req.Header.Set("X-CMC_PRO_API_KEY", s.apiKey)
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode != 200 {
+		return fetchResult{}, &statusError{Service: "coinmarketcap", Code: resp.StatusCode}
+	}
+
+	var data cmcQuotesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return fetchResult{}, err
+	}
+	// The response is keyed by CMC's numeric id; index it by slug instead.
+	bySlug := map[string]map[string]cmcQuote{}
+	for _, d := range data.Data {
+		quotes := map[string]cmcQuote{}
+		for cur, q := range d.Quote {
+			quotes[strings.ToLower(cur)] = q
+		}
+		bySlug[d.Slug] = quotes
+	}
+	return collectPrices("coinmarketcap", coins, currencies, s.fields, func(c CoinSpec, cur string) (float64, bool) {
+		q, ok := bySlug[cmcSlug(c)][cur]
+		return q.Price, ok
+	}, func(c CoinSpec, cur string) marketData {
+		q := bySlug[cmcSlug(c)][cur]
+		return marketData{
+			MarketCap: fieldValue(s.fields.MarketCap, q.MarketCap, true),
+			Volume24h: fieldValue(s.fields.Volume, q.Volume24h, true),
+			Change24h: fieldValue(s.fields.Change, q.Change24h, true),
+		}
+	})
+}
+
+func cmcSlug(c CoinSpec) string {
+	if c.CMCSlug != "" {
+		return c.CMCSlug
+	}
+	return c.ID
+}
+
+// === CRYPTOCOMPARE ===
+
+// cryptoCompareURL is a var so it can be pointed at a local stub server.
+var cryptoCompareURL = "https://min-api.cryptocompare.com"
+
+// cryptoCompareSource looks coins up by symbol. The API key is optional;
+// without one requests count against the free per-IP limit.
+type cryptoCompareSource struct {
+	apiKey string
+	fields marketFields
+}
+
+// cryptoCompareResponse is /data/pricemultifull. RAW is keyed by symbol,
+// then by currency code. Errors, rate limiting included, come back with
+// status 200 and Response "Error".
+type cryptoCompareResponse struct {
+	Response string                                   `json:"Response"`
+	Message  string                                   `json:"Message"`
+	Raw      map[string]map[string]cryptoCompareQuote `json:"RAW"`
+}
+
+type cryptoCompareQuote struct {
+	Price     float64 `json:"PRICE"`
+	MarketCap float64 `json:"MKTCAP"`
+	Volume24h float64 `json:"VOLUME24HOURTO"`
+	Change24h float64 `json:"CHANGEPCT24HOUR"`
+}
+
+func (cryptoCompareSource) Name() string { return "cryptocompare" }
+
+func (s cryptoCompareSource) Fetch(ctx context.Context, coins []CoinSpec, currencies []string) (fetchResult, error) {
+	var symbols []string
+	for _, c := range coins {
+		if sym := strings.ToUpper(coinSymbol(c)); !slices.Contains(symbols, sym) {
+			symbols = append(symbols, sym)
+		}
+	}
+	q := url.Values{}
+	q.Set("fsyms", strings.Join(symbols, ","))
+	q.Set("tsyms", strings.ToUpper(strings.Join(currencies, ",")))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cryptoCompareURL+"/data/pricemultifull?"+q.Encode(), nil)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	if s.apiKey != "" {
+		req.Header.Set("Authorization", "Apikey "+s.apiKey)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode != 200 {
+		return fetchResult{}, &statusError{Service: "cryptocompare", Code: resp.StatusCode}
+	}
+
+	var data cryptoCompareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return fetchResult{}, err
+	}
+	if data.Response == "Error" {
+		return fetchResult{}, fmt.Errorf("cryptocompare: %s", data.Message)
+	}
+	quote := func(c CoinSpec, cur string) (cryptoCompareQuote, bool) {
+		q, ok := data.Raw[strings.ToUpper(coinSymbol(c))][strings.ToUpper(cur)]
+		return q, ok
+	}
+	return collectPrices("cryptocompare", coins, currencies, s.fields, func(c CoinSpec, cur string) (float64, bool) {
+		q, ok := quote(c, cur)
+		return q.Price, ok
+	}, func(c CoinSpec, cur string) marketData {
+		q, _ := quote(c, cur)
+		return marketData{
+			MarketCap: fieldValue(s.fields.MarketCap, q.MarketCap, true),
+			Volume24h: fieldValue(s.fields.Volume, q.Volume24h, true),
+			Change24h: fieldValue(s.fields.Change, q.Change24h, true),
+		}
+	})
+}
+
+// === RATE LIMIT ===
+
+var errRateLimited = errors.New("too many queued requests, rate limit wait exceeded")
+
+// minIntervalLimiter lets callers through at most once per interval. Each
+// caller reserves the next free slot, then sleeps until it comes round.
+type minIntervalLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait blocks until the caller's slot, or returns errRateLimited without
+// taking one if that is further away than maxWait. It returns early with
+// ctx's error if ctx ends first.
+func (l *minIntervalLimiter) wait(ctx context.Context, maxWait time.Duration) error {
+	l.mu.Lock()
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	delay := slot.Sub(now)
+	if delay > maxWait {
+		l.mu.Unlock()
+		return errRateLimited
+	}
+	l.next = slot.Add(l.interval)
+	l.mu.Unlock()
+
+	return sleepCtx(ctx, delay)
+}
+
+func (l *minIntervalLimiter) setInterval(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = d
+}
+
+// holdUntil keeps every caller waiting until at least t.
+func (l *minIntervalLimiter) holdUntil(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.next) {
+		l.next = t
+	}
+}
+
+// throttle is a poll interval multiplier. Each job that saw a rate-limit
+// signal doubles it, up to maxThrottleFactor, and each job that didn't
+// halves it back towards 1.
+type throttle struct {
+	mu      sync.Mutex
+	factor  int
+	limited bool
+}
+
+// limit records a rate-limit signal for the current job.
+func (t *throttle) limit() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limited = true
+}
+
+// settle ends a job, adjusting the factor by whether it was rate limited.
+func (t *throttle) settle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limited {
+		t.factor = min(t.factor*2, maxThrottleFactor)
+	} else {
+		t.factor = max(t.factor/2, 1)
+	}
+	t.limited = false
+}
+
+// scale stretches d by the current factor.
+func (t *throttle) scale(d time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return d * time.Duration(t.factor)
+}
+
+// === RETRY ===
+
+const (
+	defaultMaxRetries    = 3
+	defaultBaseBackoffMs = 1000
+	// maxRetryBackoff caps the wait between attempts, before jitter.
+	maxRetryBackoff = 5 * time.Minute
+)
+
+// statusError is a non-2xx HTTP response from an upstream service.
+// RetryAfter is the upstream's Retry-After, if it sent one.
+type statusError struct {
+	Service    string
+	Code       int
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned %d", e.Service, e.Code)
+}
+
+// isRetryable reports whether err is worth another attempt: network
+// failures, 429 and 5xx. Other statuses and decode errors are final.
+func isRetryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Code == http.StatusTooManyRequests || se.Code >= 500
+	}
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
+
+// fetchPricesWithRetry fetches from src, backing off exponentially with
+// jitter between retryable failures. The last error is returned if every
+// attempt fails.
+func fetchPricesWithRetry(ctx context.Context, cfg Config, src PriceSource) (fetchResult, error) {
+	retries := cfg.MaxRetries
+	if retries == 0 {
+		retries = defaultMaxRetries
+	}
+	base := cfg.BaseBackoffMs
+	if base == 0 {
+		base = defaultBaseBackoffMs
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := src.Fetch(ctx, cfg.Coins, cfg.Currencies)
+		if err == nil {
+			return res, nil
+		}
+		if attempt >= retries || !isRetryable(err) || ctx.Err() != nil {
+			return fetchResult{}, err
+		}
+		backoff := retryBackoff(base, attempt)
+		backoff += time.Duration(rand.Int64N(int64(backoff)/2 + 1))
+		// An explicit Retry-After replaces the backoff; one longer than we'd
+		// block a request for is left to the next, slowed-down run.
+		var se *statusError
+		if errors.As(err, &se) && se.RetryAfter > 0 {
+			if se.RetryAfter > maxRateLimitWait {
+				slog.Warn("Retry-After too long to wait out, giving up until the next run", "event", "fetch_retry_after", "source", src.Name(), "retry_after_s", se.RetryAfter.Seconds())
+				return fetchResult{}, err
+			}
+			backoff = se.RetryAfter
+		}
+		slog.Warn("fetch attempt failed, retrying", "event", "fetch_retry", "source", src.Name(), "attempt", attempt+1, "backoff_ms", backoff.Milliseconds(), "error", err)
+		if err := sleepCtx(ctx, backoff); err != nil {
+			return fetchResult{}, err
+		}
+	}
+}
+
+// retryBackoff is baseMs doubled once per earlier attempt, capped at
+// maxRetryBackoff so a large max_retries can't overflow it.
+func retryBackoff(baseMs, attempt int) time.Duration {
+	limit := maxRetryBackoff.Milliseconds()
+	ms := int64(baseMs)
+	for range attempt {
+		if ms >= limit {
+			break
+		}
+		ms *= 2
+	}
+	return time.Duration(min(ms, limit)) * time.Millisecond
+}
+
+// sleepCtx sleeps for d, or returns ctx's error as soon as it ends.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// === CIRCUIT BREAKER ===
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 5 * time.Minute
+)
+
+// errCircuitOpen is returned instead of fetching while the breaker is open.
+var errCircuitOpen = errors.New("price source circuit open, fetch skipped")
+
+// circuitBreaker stops the job from fetching after a run of consecutive
+// failures, so an outage doesn't cost a timeout every cycle. It opens after
+// the failure threshold, lets one trial fetch through (half-open) once the
+// cooldown has passed, and closes again on the first success.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openUntil time.Time
+}
+
+// breakerStatus is the breaker as /healthz reports it.
+type breakerStatus struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"consecutive_failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+func newCircuitBreaker() *circuitBreaker { return &circuitBreaker{state: "closed"} }
+
+// allow reports whether a fetch may go ahead at now, moving an open breaker
+// whose cooldown has passed to half-open.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == "open" {
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = "half-open"
+		slog.Info("price source circuit half-open, trying a fetch", "event", "breaker_half_open")
+	}
+	return true
+}
+
+// record counts a fetch result against cfg's thresholds: a success closes
+// the breaker, and a failure in half-open or the threshold-th in a row opens
+// it for the cooldown.
+func (b *circuitBreaker) record(cfg Config, err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state != "closed" {
+			slog.Info("price source recovered, circuit closed", "event", "breaker_closed", "failures", b.failures)
+		}
+		b.state, b.failures = "closed", 0
+		return
+	}
+	b.failures++
+	threshold, cooldown := breakerLimits(cfg)
+	if b.state == "half-open" || b.failures >= threshold {
+		b.state, b.openUntil = "open", now.Add(cooldown)
+		slog.Warn("price source circuit open, skipping fetches", "event", "breaker_open",
+			"failures", b.failures, "cooldown_s", cooldown.Seconds())
+	}
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := breakerStatus{State: b.state, Failures: b.failures}
+	if b.state == "open" {
+		until := b.openUntil
+		st.OpenUntil = &until
+	}
+	return st
+}
+
+// breakerLimits returns the configured failure threshold and cooldown, or
+// their defaults.
+func breakerLimits(cfg Config) (int, time.Duration) {
+	threshold, cooldown := cfg.BreakerFailures, time.Duration(cfg.BreakerCooldownSeconds)*time.Second
+	if threshold <= 0 {
+		threshold = defaultBreakerFailures
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return threshold, cooldown
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubCoinGecko points the CoinGecko endpoint at h for the duration of the
+// test, with requests no longer spaced out or throttled.
+func stubCoinGecko(t *testing.T, h http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	oldURL, oldLimiter, oldThrottle := coinGeckoPublicURL, coinGeckoLimiter, coinGeckoThrottle
+	coinGeckoPublicURL = srv.URL
+	coinGeckoLimiter = &minIntervalLimiter{}
+	coinGeckoThrottle = &throttle{factor: 1}
+	t.Cleanup(func() {
+		srv.Close()
+		coinGeckoPublicURL, coinGeckoLimiter, coinGeckoThrottle = oldURL, oldLimiter, oldThrottle
+	})
+}
+
+func TestFetchPricesCoinGecko(t *testing.T) {
+	cfg := Config{
+		Coins:         []CoinSpec{{ID: "bitcoin"}, {ID: "ethereum"}},
+		Currencies:    []string{"usd", "eur"},
+		MaxRetries:    2,
+		BaseBackoffMs: 1,
+	}
+
+	t.Run("canned json", func(t *testing.T) {
+		stubCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"bitcoin":{"usd":107432.5,"eur":99000},"ethereum":{"usd":3500.25,"eur":3200}}`))
+		})
+		res, err := fetchPricesWithRetry(context.Background(), cfg, coinGeckoSource{cfg: cfg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]map[string]float64{
+			"bitcoin":  {"usd": 107432.5, "eur": 99000},
+			"ethereum": {"usd": 3500.25, "eur": 3200},
+		}
+		if !reflect.DeepEqual(res.Prices, want) {
+			t.Errorf("prices = %v, want %v", res.Prices, want)
+		}
+		if len(res.Missing) != 0 {
+			t.Errorf("missing = %v, want none", res.Missing)
+		}
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		var calls atomic.Int32
+		stubCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusTooManyRequests)
+		})
+		_, err := fetchPricesWithRetry(context.Background(), cfg, coinGeckoSource{cfg: cfg})
+		var se *statusError
+		if !errors.As(err, &se) || se.Code != http.StatusTooManyRequests {
+			t.Fatalf("err = %v, want a 429 statusError", err)
+		}
+		if !isRetryable(err) {
+			t.Error("429 not classed as retryable")
+		}
+		if got := calls.Load(); got != int32(cfg.MaxRetries+1) {
+			t.Errorf("%d requests, want %d", got, cfg.MaxRetries+1)
+		}
+	})
+
+	t.Run("malformed body", func(t *testing.T) {
+		var calls atomic.Int32
+		stubCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.Write([]byte(`{"bitcoin":{"usd":`))
+		})
+		_, err := fetchPricesWithRetry(context.Background(), cfg, coinGeckoSource{cfg: cfg})
+		if err == nil {
+			t.Fatal("no error for a truncated body")
+		}
+		if isRetryable(err) {
+			t.Errorf("decode error %v classed as retryable", err)
+		}
+		if got := calls.Load(); got != 1 {
+			t.Errorf("%d requests, want 1", got)
+		}
+	})
+}
+
+func TestCoinGeckoQueryEncoding(t *testing.T) {
+	var got string
+	stubCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RawQuery
+		w.Write([]byte(`{"bit coin&x":{"usd":1}}`))
+	})
+	cfg := Config{}
+	coins := []CoinSpec{{ID: "bit coin&x"}, {ID: "ethereum"}}
+	if _, err := (coinGeckoSource{cfg: cfg}).Fetch(context.Background(), coins, []string{"usd", "e&r b"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ids=bit+coin%26x%2Cethereum&vs_currencies=usd%2Ce%26r+b"; got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+}
+
+func TestCoinGeckoGzip(t *testing.T) {
+	const body = `{"bitcoin":{"usd":107432.5},"ethereum":{"usd":3500.25}}`
+	cfg := Config{Coins: []CoinSpec{{ID: "bitcoin"}, {ID: "ethereum"}}, Currencies: []string{"usd"}}
+	want := map[string]map[string]float64{"bitcoin": {"usd": 107432.5}, "ethereum": {"usd": 3500.25}}
+
+	t.Run("gzip response", func(t *testing.T) {
+		var zipped bytes.Buffer
+		zw := gzip.NewWriter(&zipped)
+		zw.Write([]byte(body))
+		zw.Close()
+		stubCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+			if ae := r.Header.Get("Accept-Encoding"); ae != "gzip" {
+				t.Errorf("Accept-Encoding = %q, want gzip", ae)
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(zipped.Bytes())
+		})
+		logged := captureLog(t)
+		res, err := (coinGeckoSource{cfg: cfg}).Fetch(context.Background(), cfg.Coins, cfg.Currencies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Prices, want) {
+			t.Errorf("prices = %v, want %v", res.Prices, want)
+		}
+		entries := logged("coingecko_gzip")
+		if len(entries) != 1 {
+			t.Fatalf("logged %v, want one coingecko_gzip entry", entries)
+		}
+		if got := entries[0]["compressed_bytes"]; got != float64(zipped.Len()) {
+			t.Errorf("compressed_bytes = %v, want %d", got, zipped.Len())
+		}
+		if got := entries[0]["decoded_bytes"]; got != float64(len(body)) {
+			t.Errorf("decoded_bytes = %v, want %d", got, len(body))
+		}
+	})
+
+	t.Run("server ignores Accept-Encoding", func(t *testing.T) {
+		stubCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})
+		logged := captureLog(t)
+		res, err := (coinGeckoSource{cfg: cfg}).Fetch(context.Background(), cfg.Coins, cfg.Currencies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Prices, want) {
+			t.Errorf("prices = %v, want %v", res.Prices, want)
+		}
+		if entries := logged("coingecko_gzip"); len(entries) != 0 {
+			t.Errorf("logged %v for a plain response", entries)
+		}
+	})
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		base, attempt int
+		want          time.Duration
+	}{
+		{1000, 0, time.Second},
+		{1000, 3, 8 * time.Second},
+		{1000, 8, 256 * time.Second},
+		{1000, 9, maxRetryBackoff},
+		{1000, 100, maxRetryBackoff},
+		{1, 1 << 20, maxRetryBackoff},
+		{1 << 62, 2, maxRetryBackoff},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.base, tt.attempt); got != tt.want {
+			t.Errorf("retryBackoff(%d, %d) = %v, want %v", tt.base, tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// === STORE ===
+
+// Store is the persistence the job works against: sqlStore in production,
+// memStore where a database isn't wanted (e.g. exercising the pipeline with
+// stub sources and channels).
+type Store interface {
+	// Save stores the records of one fetch.
+	Save(ctx context.Context, records []PriceRecord) error
+	// Latest returns the most recent price per coin and currency.
+	Latest() (map[string]map[string]float64, error)
+	// DailyRange returns the 24h high and low, or errNotEnoughHistory when
+	// there is nothing stored for that period.
+	DailyRange(coin, currency string) (high, low float64, err error)
+	// Recent returns up to the last n prices, oldest first.
+	Recent(coin, currency string, n int) ([]float64, error)
+	// MovingAverage returns the mean price over the last window, or
+	// errNotEnoughHistory unless history goes back at least that far.
+	MovingAverage(coin, currency string, window time.Duration) (float64, error)
+	// SaveRun records the outcome of one job's fetch and save.
+	SaveRun(run fetchRun) error
+	// SavePortfolio records the holdings' value at one fetch.
+	SavePortfolio(v portfolioValue) error
+
+	notificationQueue
+}
+
+// notificationQueue holds notifications waiting for redelivery, and logs
+// every send attempt so deliveries can be reviewed later.
+type notificationQueue interface {
+	LogNotification(a notificationAttempt) error
+	QueueNotification(channel, text string, sendErr error) error
+	// PendingNotifications returns the queue oldest first.
+	PendingNotifications() ([]failedNotification, error)
+	RecordRedeliveryAttempt(id int64, sendErr error) error
+	DeleteNotification(id int64) error
+}
+
+// sqlStore is the Store backed by the tables initDB or initPostgres creates.
+type sqlStore struct {
+	db *DB
+}
+
+func (s sqlStore) Save(ctx context.Context, records []PriceRecord) error {
+	return savePrices(ctx, s.db, records)
+}
+
+func (s sqlStore) Latest() (map[string]map[string]float64, error) { return loadLastPrices(s.db) }
+
+func (s sqlStore) DailyRange(coin, currency string) (float64, float64, error) {
+	return dailyRange(s.db, coin, currency)
+}
+
+func (s sqlStore) Recent(coin, currency string, n int) ([]float64, error) {
+	return recentPrices(s.db, coin, currency, n)
+}
+
+func (s sqlStore) MovingAverage(coin, currency string, window time.Duration) (float64, error) {
+	return movingAverage(s.db, coin, currency, window)
+}
+
+func (s sqlStore) SaveRun(run fetchRun) error { return saveFetchRun(s.db, run) }
+
+func (s sqlStore) SavePortfolio(v portfolioValue) error { return savePortfolioValue(s.db, v) }
+
+func (s sqlStore) LogNotification(a notificationAttempt) error { return logNotification(s.db, a) }
+
+func (s sqlStore) QueueNotification(channel, text string, sendErr error) error {
+	return queueFailedNotification(s.db, channel, text, sendErr)
+}
+
+func (s sqlStore) PendingNotifications() ([]failedNotification, error) {
+	return loadFailedNotifications(s.db)
+}
+
+func (s sqlStore) RecordRedeliveryAttempt(id int64, sendErr error) error {
+	return recordRedeliveryAttempt(s.db, id, sendErr)
+}
+
+func (s sqlStore) DeleteNotification(id int64) error { return deleteFailedNotification(s.db, id) }
+
+// memStore is a Store that keeps everything in memory and is lost on exit.
+type memStore struct {
+	mu        sync.Mutex
+	records   []PriceRecord
+	runs      []fetchRun
+	portfolio []portfolioValue
+	sent      []notificationAttempt
+	queue     []failedNotification
+	nextID    int64
+}
+
+func newMemStore() *memStore { return &memStore{} }
+
+func (m *memStore) Save(_ context.Context, records []PriceRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Like the unique index on prices: a record for a time already stored
+	// replaces the old one.
+	for _, r := range records {
+		i := slices.IndexFunc(m.records, func(o PriceRecord) bool {
+			return o.Coin == r.Coin && o.Currency == r.Currency && o.FetchedAt.Equal(r.FetchedAt)
+		})
+		if i >= 0 {
+			m.records[i] = r
+		} else {
+			m.records = append(m.records, r)
+		}
+	}
+	return nil
+}
+
+func (m *memStore) Latest() (map[string]map[string]float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := map[string]map[string]float64{}
+	at := map[string]time.Time{}
+	for _, r := range m.records {
+		key := r.Coin + "/" + r.Currency
+		if prev, ok := at[key]; ok && r.FetchedAt.Before(prev) {
+			continue
+		}
+		at[key] = r.FetchedAt
+		if out[r.Coin] == nil {
+			out[r.Coin] = map[string]float64{}
+		}
+		out[r.Coin][r.Currency] = r.Price
+	}
+	return out, nil
+}
+
+// series returns the stored prices of coin in currency, oldest first.
+func (m *memStore) series(coin, currency string) []PriceRecord {
+	var out []PriceRecord
+	for _, r := range m.records {
+		if r.Coin == coin && r.Currency == currency {
+			out = append(out, r)
+		}
+	}
+	slices.SortStableFunc(out, func(a, b PriceRecord) int { return a.FetchedAt.Compare(b.FetchedAt) })
+	return out
+}
+
+func (m *memStore) DailyRange(coin, currency string) (float64, float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	since := now().Add(-24 * time.Hour)
+	var high, low float64
+	found := false
+	for _, r := range m.series(coin, currency) {
+		if r.FetchedAt.Before(since) {
+			continue
+		}
+		if !found || r.Price > high {
+			high = r.Price
+		}
+		if !found || r.Price < low {
+			low = r.Price
+		}
+		found = true
+	}
+	if !found {
+		return 0, 0, errNotEnoughHistory
+	}
+	return high, low, nil
+}
+
+func (m *memStore) Recent(coin, currency string, n int) ([]float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.series(coin, currency)
+	s = s[max(0, len(s)-n):]
+	out := make([]float64, 0, len(s))
+	for _, r := range s {
+		out = append(out, r.Price)
+	}
+	return out, nil
+}
+
+func (m *memStore) MovingAverage(coin, currency string, window time.Duration) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	since := now().Add(-window)
+	s := m.series(coin, currency)
+	if len(s) == 0 || s[0].FetchedAt.After(since) {
+		return 0, errNotEnoughHistory
+	}
+	var sum float64
+	var n int
+	for _, r := range s {
+		if !r.FetchedAt.Before(since) {
+			sum += r.Price
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, errNotEnoughHistory
+	}
+	return sum / float64(n), nil
+}
+
+func (m *memStore) SaveRun(run fetchRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs = append(m.runs, run)
+	return nil
+}
+
+func (m *memStore) SavePortfolio(v portfolioValue) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.portfolio = append(m.portfolio, v)
+	return nil
+}
+
+func (m *memStore) LogNotification(a notificationAttempt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, a)
+	return nil
+}
+
+func (m *memStore) QueueNotification(channel, text string, sendErr error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	m.queue = append(m.queue, failedNotification{ID: m.nextID, Channel: channel, Text: text})
+	return nil
+}
+
+func (m *memStore) PendingNotifications() ([]failedNotification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.queue), nil
+}
+
+func (m *memStore) RecordRedeliveryAttempt(id int64, sendErr error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.queue {
+		if m.queue[i].ID == id {
+			m.queue[i].Attempts++
+		}
+	}
+	return nil
+}
+
+func (m *memStore) DeleteNotification(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queue = slices.DeleteFunc(m.queue, func(f failedNotification) bool { return f.ID == id })
+	return nil
+}
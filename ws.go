@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// === WEBSOCKET ===
+
+const (
+	defaultWSMaxClients = 50
+	wsWriteTimeout      = 10 * time.Second
+)
+
+// priceHub fans each new price snapshot out to the connected /ws clients.
+// Every client has a one-slot buffer that only ever holds the latest
+// snapshot, so a slow client skips updates instead of holding up the job.
+type priceHub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]struct{}
+	closed  bool
+}
+
+type wsClient struct {
+	send   chan []byte
+	cancel context.CancelFunc
+}
+
+func newPriceHub() *priceHub { return &priceHub{clients: map[*wsClient]struct{}{}} }
+
+// add registers c unless max clients are already connected or the hub is
+// closed.
+func (h *priceHub) add(c *wsClient, max int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed || len(h.clients) >= max {
+		return false
+	}
+	h.clients[c] = struct{}{}
+	return true
+}
+
+func (h *priceHub) remove(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+// broadcast queues msg for every client, replacing any snapshot a client
+// hasn't been sent yet.
+func (h *priceHub) broadcast(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		select {
+		case <-c.send:
+		default:
+		}
+		select {
+		case c.send <- msg:
+		default:
+		}
+	}
+}
+
+// close disconnects every client and refuses new ones, for shutdown.
+func (h *priceHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for c := range h.clients {
+		c.cancel()
+	}
+}
+
+// publish sends snap to the /ws clients in the same shape as /latest.
+func (s *server) publish(snap priceSnapshot) {
+	msg, err := json.Marshal(s.latestResponse(snap))
+	if err != nil {
+		slog.Warn("could not encode price snapshot", "event", "ws_error", "error", err)
+		return
+	}
+	s.hub.broadcast(msg)
+}
+
+// handleWS serves GET /ws: a WebSocket that gets the current snapshot on
+// connect and then every new one as /latest would return it. Anything the
+// client sends is ignored. Past WSMaxClients connections it answers 503.
+func (s *server) handleWS(w http.ResponseWriter, r *http.Request) {
+	max := s.config().WSMaxClients
+	if max <= 0 {
+		max = defaultWSMaxClients
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &wsClient{send: make(chan []byte, 1), cancel: cancel}
+	if !s.hub.add(c, max) {
+		writeError(w, http.StatusServiceUnavailable, "too many websocket clients")
+		return
+	}
+	defer s.hub.remove(c)
+
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		slog.Warn("websocket handshake failed", "event", "ws_error", "error", err)
+		return
+	}
+	defer conn.CloseNow()
+	slog.Info("websocket client connected", "event", "ws_connect", "remote", r.RemoteAddr)
+
+	if snap := s.latest.GetAll(); !snap.FetchedAt.IsZero() {
+		if msg, err := json.Marshal(s.latestResponse(snap)); err == nil {
+			// A broadcast may have queued a newer one already.
+			select {
+			case c.send <- msg:
+			default:
+			}
+		}
+	}
+	// CloseRead handles pings and the close handshake, and its context ends
+	// when the client goes away. ctx only ends when the hub closes.
+	gone := conn.CloseRead(context.Background())
+	for {
+		select {
+		case <-gone.Done():
+			slog.Info("websocket client disconnected", "event", "ws_disconnect", "remote", r.RemoteAddr)
+			return
+		case <-ctx.Done():
+			conn.Close(websocket.StatusGoingAway, "server shutting down")
+			return
+		case msg := <-c.send:
+			wctx, wcancel := context.WithTimeout(gone, wsWriteTimeout)
+			err := conn.Write(wctx, websocket.MessageText, msg)
+			wcancel()
+			if err != nil {
+				slog.Info("websocket write failed, dropping client", "event", "ws_disconnect", "remote", r.RemoteAddr, "error", err)
+				return
+			}
+		}
+	}
+}